@@ -0,0 +1,258 @@
+package razproxy
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// SessionInfo describes a connected session
+type SessionInfo struct {
+	ID         string    `json:"id"`
+	User       string    `json:"user"`
+	Policy     string    `json:"policy,omitempty"`
+	RemoteAddr string    `json:"remote_addr"`
+	Connected  time.Time `json:"connected"`
+	Streams    int       `json:"streams"`
+	BytesUp    int64     `json:"bytes_up"`   // sent by the client to destinations
+	BytesDown  int64     `json:"bytes_down"` // received by the client from destinations
+}
+
+// StreamInfo describes a proxied connection of a session
+type StreamInfo struct {
+	Dest      string    `json:"dest"`
+	Opened    time.Time `json:"opened"`
+	BytesUp   int64     `json:"bytes_up"`
+	BytesDown int64     `json:"bytes_down"`
+}
+
+// Sessions returns the connected sessions
+func (s *Server) Sessions() []SessionInfo {
+	s.sessionsMtx.Lock()
+	defer s.sessionsMtx.Unlock()
+
+	sessions := make([]SessionInfo, 0, len(s.sessions))
+	for session := range s.sessions {
+		sessions = append(sessions, session.info())
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].Connected.Before(sessions[j].Connected)
+	})
+	return sessions
+}
+
+// Streams returns the proxied connections of the sessions with the given ID
+func (s *Server) Streams(id string) []StreamInfo {
+	streams := make([]StreamInfo, 0)
+	s.sessionsMtx.Lock()
+	defer s.sessionsMtx.Unlock()
+	for session := range s.sessions {
+		if session.sessionID() == id {
+			streams = append(streams, session.streamInfos()...)
+		}
+	}
+	return streams
+}
+
+// Kick closes the sessions with the given ID and returns their number
+func (s *Server) Kick(id string) int {
+	return s.kick(func(session *serverSession) bool {
+		return session.sessionID() == id
+	})
+}
+
+// KickUser closes the sessions of a user and returns their number
+func (s *Server) KickUser(user string) int {
+	return s.kick(func(session *serverSession) bool {
+		sessionUser, _, authenticated := session.identity()
+		return authenticated && sessionUser == user
+	})
+}
+
+func (s *Server) kick(match func(session *serverSession) bool) int {
+	s.sessionsMtx.Lock()
+	defer s.sessionsMtx.Unlock()
+	var n int
+	for session := range s.sessions {
+		if match(session) {
+			session.log("kicked")
+			session.session.Close()
+			n++
+		}
+	}
+	return n
+}
+
+// FlushDNSCache clears the DNS cache of every session
+func (s *Server) FlushDNSCache() {
+	s.sessionsMtx.Lock()
+	defer s.sessionsMtx.Unlock()
+	for session := range s.sessions {
+		session.flushDNSCache()
+	}
+}
+
+// RateLimits returns the number of tunnels each IP may open right now
+func (s *Server) RateLimits() map[string]float64 {
+	return s.rate.tokens()
+}
+
+// AdminHandler returns the handler of the admin HTTP/JSON API
+//
+// Requests have to send the token in an "Authorization: Bearer <token>" header.
+// reload is called by POST /reload and may be nil.
+//
+//	GET    /sessions               list sessions
+//	GET    /sessions/{id}/streams  list the proxied connections of a session
+//	DELETE /sessions/{id}          kick a session
+//	DELETE /users/{user}           kick the sessions of a user
+//	POST   /dns/flush              flush the DNS caches
+//	GET    /ratelimits             dump the rate limiter state
+//	POST   /reload                 reload the settings
+func (s *Server) AdminHandler(token string, reload func() error) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /sessions", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, s.Sessions())
+	})
+	mux.HandleFunc("GET /sessions/{id}/streams", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, s.Streams(r.PathValue("id")))
+	})
+	mux.HandleFunc("DELETE /sessions/{id}", func(w http.ResponseWriter, r *http.Request) {
+		writeKicked(w, s.Kick(r.PathValue("id")))
+	})
+	mux.HandleFunc("DELETE /users/{user}", func(w http.ResponseWriter, r *http.Request) {
+		writeKicked(w, s.KickUser(r.PathValue("user")))
+	})
+	mux.HandleFunc("POST /dns/flush", func(w http.ResponseWriter, r *http.Request) {
+		s.FlushDNSCache()
+		writeJSON(w, http.StatusOK, map[string]bool{"ok": true})
+	})
+	mux.HandleFunc("GET /ratelimits", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, s.RateLimits())
+	})
+	mux.HandleFunc("POST /reload", func(w http.ResponseWriter, r *http.Request) {
+		if reload == nil {
+			writeJSON(w, http.StatusNotImplemented, map[string]string{"error": "reload is not supported"})
+			return
+		}
+		if err := reload(); err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]bool{"ok": true})
+	})
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := []byte(r.Header.Get("Authorization"))
+		if len(token) == 0 || subtle.ConstantTimeCompare(auth, []byte("Bearer "+token)) != 1 {
+			writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeKicked(w http.ResponseWriter, n int) {
+	if n == 0 {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "no such session"})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]int{"kicked": n})
+}
+
+// trackedConn counts the bytes of a proxied connection for the admin API
+type trackedConn struct {
+	net.Conn
+	session *serverSession
+	dest    string
+	opened  time.Time
+	up      int64
+	down    int64
+	once    sync.Once
+}
+
+// track registers a proxied connection in the session until it is closed
+func (s *serverSession) track(dest string, conn net.Conn) net.Conn {
+	c := &trackedConn{
+		Conn:    conn,
+		session: s,
+		dest:    dest,
+		opened:  time.Now(),
+	}
+	s.streamsMtx.Lock()
+	s.streams[c] = true
+	s.streamsMtx.Unlock()
+	return c
+}
+
+func (c *trackedConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	atomic.AddInt64(&c.down, int64(n))
+	atomic.AddInt64(&c.session.bytesDown, int64(n))
+	return n, err
+}
+
+func (c *trackedConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	atomic.AddInt64(&c.up, int64(n))
+	atomic.AddInt64(&c.session.bytesUp, int64(n))
+	return n, err
+}
+
+// CloseWrite keeps half-closing working through the wrapper
+func (c *trackedConn) CloseWrite() error {
+	return closeWrite(c.Conn)
+}
+
+func (c *trackedConn) Close() error {
+	c.once.Do(func() {
+		c.session.streamsMtx.Lock()
+		delete(c.session.streams, c)
+		c.session.streamsMtx.Unlock()
+	})
+	return c.Conn.Close()
+}
+
+func (s *serverSession) info() SessionInfo {
+	s.identityMtx.RLock()
+	defer s.identityMtx.RUnlock()
+	return SessionInfo{
+		ID:         s.id,
+		User:       s.user,
+		Policy:     s.policy,
+		RemoteAddr: s.session.RemoteAddr().String(),
+		Connected:  s.connected,
+		Streams:    s.session.NumStreams(),
+		BytesUp:    atomic.LoadInt64(&s.bytesUp),
+		BytesDown:  atomic.LoadInt64(&s.bytesDown),
+	}
+}
+
+func (s *serverSession) streamInfos() []StreamInfo {
+	s.streamsMtx.Lock()
+	defer s.streamsMtx.Unlock()
+	streams := make([]StreamInfo, 0, len(s.streams))
+	for c := range s.streams {
+		streams = append(streams, StreamInfo{
+			Dest:      c.dest,
+			Opened:    c.opened,
+			BytesUp:   atomic.LoadInt64(&c.up),
+			BytesDown: atomic.LoadInt64(&c.down),
+		})
+	}
+	sort.Slice(streams, func(i, j int) bool {
+		return streams[i].Opened.Before(streams[j].Opened)
+	})
+	return streams
+}
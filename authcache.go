@@ -0,0 +1,59 @@
+package razproxy
+
+import (
+	"crypto/sha256"
+	"sync"
+	"time"
+)
+
+// authCache remembers successful logins of remote authenticators for a while,
+// so the backend is not asked on every reconnect
+type authCache struct {
+	mtx     sync.Mutex
+	entries map[[32]byte]authCacheEntry
+}
+
+type authCacheEntry struct {
+	id      Identity
+	expires time.Time
+}
+
+func authCacheKey(user, password string) [32]byte {
+	return sha256.Sum256([]byte(user + "\x00" + password))
+}
+
+func (c *authCache) get(user, password string) (Identity, bool) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	key := authCacheKey(user, password)
+	entry, ok := c.entries[key]
+	if !ok {
+		return Identity{}, false
+	}
+	if time.Now().After(entry.expires) {
+		delete(c.entries, key)
+		return Identity{}, false
+	}
+	return entry.id, true
+}
+
+func (c *authCache) put(user, password string, id Identity, ttl time.Duration) {
+	if ttl <= 0 {
+		return
+	}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.entries == nil {
+		c.entries = make(map[[32]byte]authCacheEntry)
+	}
+	now := time.Now()
+	for key, entry := range c.entries {
+		if now.After(entry.expires) {
+			delete(c.entries, key)
+		}
+	}
+	c.entries[authCacheKey(user, password)] = authCacheEntry{
+		id:      id,
+		expires: now.Add(ttl),
+	}
+}
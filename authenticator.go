@@ -1,10 +1,115 @@
 package razproxy
 
-// Authenticator ...
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// ErrInvalidCredentials is returned by authenticators when the credentials were
+// checked and rejected, as opposed to errors of the authentication backend
+var ErrInvalidCredentials = errors.New("invalid credentials")
+
+// invalidCredentialsf returns an error wrapping ErrInvalidCredentials with the reason of the rejection
+func invalidCredentialsf(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: %s", ErrInvalidCredentials, fmt.Sprintf(format, args...))
+}
+
+// Identity is the user that the credentials of a client belong to
+type Identity struct {
+	User string
+	// Policy is assigned by the authenticator, e.g. based on the groups of the user.
+	// UserOutbounds and UserClasses of the server refer to policies as "@policy".
+	Policy     string
+	Groups     []string
+	Attributes map[string]string // additional attributes of the user, e.g. its DN in a directory
+}
+
+// Authenticator checks the passwords of clients
+//
+// Simple authenticators can implement it instead of ContextAuthenticator, and
+// be passed to NewServer or Reload with AdaptAuthenticator.
 type Authenticator interface {
 	Valid(user, password string) bool
 }
 
+// ContextAuthenticator checks the credentials of clients and returns the identity they belong to
+//
+// Errors wrapping ErrInvalidCredentials mean that the credentials are wrong, and
+// their reason is reported to the client. Other errors mean that the credentials
+// could not be checked, e.g. because the backend is unreachable, so the client
+// may try again later. Authenticate has to return when ctx is done.
+type ContextAuthenticator interface {
+	Authenticate(ctx context.Context, req AuthRequest) (Identity, error)
+}
+
+// IdentityChecker is implemented by authenticators that can tell whether an
+// identity they accepted earlier is still accepted without asking their backend,
+// so Reload can check the sessions again without keeping the passwords of users
+//
+// password reports whether a password matches the one the user logged in with.
+type IdentityChecker interface {
+	CheckIdentity(id Identity, password func(string) bool) (Identity, error)
+}
+
+// errUncheckedIdentity means that the authenticator cannot check identities
+var errUncheckedIdentity = errors.New("authenticator cannot check identities")
+
+// checkIdentity checks an identity again with auth if it implements IdentityChecker
+func checkIdentity(auth ContextAuthenticator, id Identity, password func(string) bool) (Identity, error) {
+	if checker, ok := auth.(IdentityChecker); ok {
+		return checker.CheckIdentity(id, password)
+	}
+	return id, errUncheckedIdentity
+}
+
+// AdaptAuthenticator returns auth if it is a ContextAuthenticator, or a
+// ContextAuthenticator that checks passwords with auth otherwise
+//
+// Valid is called on a separate goroutine, so the timeout of the context is
+// enforced even if it blocks.
+func AdaptAuthenticator(auth Authenticator) ContextAuthenticator {
+	if ctxAuth, ok := auth.(ContextAuthenticator); ok {
+		return ctxAuth
+	}
+	return passwordAuthenticator{auth}
+}
+
+type passwordAuthenticator struct {
+	auth Authenticator
+}
+
+func (a passwordAuthenticator) Authenticate(ctx context.Context, req AuthRequest) (Identity, error) {
+	if req.CredentialType != CredentialPassword {
+		return Identity{}, invalidCredentialsf("unsupported credential type: %s", req.CredentialType)
+	}
+	return withContext(ctx, func() (Identity, error) {
+		if !a.auth.Valid(req.User, req.Password) {
+			return Identity{}, ErrInvalidCredentials
+		}
+		return Identity{User: req.User}, nil
+	})
+}
+
+// withContext calls fn on a separate goroutine and returns early if ctx is done
+func withContext(ctx context.Context, fn func() (Identity, error)) (Identity, error) {
+	type result struct {
+		id  Identity
+		err error
+	}
+	resultCh := make(chan result, 1)
+	go func() {
+		id, err := fn()
+		resultCh <- result{id, err}
+	}()
+	select {
+	case r := <-resultCh:
+		return r.id, r.err
+	case <-ctx.Done():
+		return Identity{}, ctx.Err()
+	}
+}
+
 // BasicAuthenticator ...
 type BasicAuthenticator map[string]string
 
@@ -14,6 +119,26 @@ func (auth BasicAuthenticator) Valid(user, password string) bool {
 	return ok && pw == password
 }
 
+// Authenticate ...
+func (auth BasicAuthenticator) Authenticate(ctx context.Context, req AuthRequest) (Identity, error) {
+	if req.CredentialType != CredentialPassword {
+		return Identity{}, invalidCredentialsf("unsupported credential type: %s", req.CredentialType)
+	}
+	if !auth.Valid(req.User, req.Password) {
+		return Identity{}, ErrInvalidCredentials
+	}
+	return Identity{User: req.User}, nil
+}
+
+// CheckIdentity ...
+func (auth BasicAuthenticator) CheckIdentity(id Identity, password func(string) bool) (Identity, error) {
+	pw, ok := auth[id.User]
+	if !ok || !password(pw) {
+		return Identity{}, ErrInvalidCredentials
+	}
+	return Identity{User: id.User}, nil
+}
+
 // NilAuthenticator ...
 type NilAuthenticator struct{}
 
@@ -21,3 +146,75 @@ type NilAuthenticator struct{}
 func (auth NilAuthenticator) Valid(user, password string) bool {
 	return user == "" && password == ""
 }
+
+// Authenticate ...
+func (auth NilAuthenticator) Authenticate(ctx context.Context, req AuthRequest) (Identity, error) {
+	if req.CredentialType != CredentialPassword {
+		return Identity{}, invalidCredentialsf("unsupported credential type: %s", req.CredentialType)
+	}
+	if !auth.Valid(req.User, req.Password) {
+		return Identity{}, ErrInvalidCredentials
+	}
+	return Identity{}, nil
+}
+
+// CheckIdentity ...
+func (auth NilAuthenticator) CheckIdentity(id Identity, password func(string) bool) (Identity, error) {
+	return id, nil
+}
+
+// ChainAuthenticator accepts the users accepted by any of its authenticators
+//
+// If none of them accepts the credentials and any of them failed with a backend
+// error, that error is returned instead of ErrInvalidCredentials, because the
+// user might have been accepted by the failing backend.
+type ChainAuthenticator []ContextAuthenticator
+
+// Authenticate ...
+func (auth ChainAuthenticator) Authenticate(ctx context.Context, req AuthRequest) (Identity, error) {
+	var invalidErr, backendErr error
+	for _, a := range auth {
+		id, err := a.Authenticate(ctx, req)
+		if err == nil {
+			return id, nil
+		}
+		if ctx.Err() != nil {
+			return Identity{}, ctx.Err()
+		}
+		if errors.Is(err, ErrInvalidCredentials) {
+			if invalidErr == nil || invalidErr == ErrInvalidCredentials {
+				invalidErr = err // keep the most specific reason
+			}
+		} else if backendErr == nil {
+			backendErr = err
+		}
+	}
+	if backendErr != nil {
+		return Identity{}, backendErr
+	}
+	if invalidErr != nil {
+		return Identity{}, invalidErr
+	}
+	return Identity{}, ErrInvalidCredentials
+}
+
+// CheckIdentity accepts the identity if any of the authenticators accepts it
+//
+// If none of them does and any of them cannot check identities, the identity is
+// not rejected, because the user might have been accepted by that authenticator.
+func (auth ChainAuthenticator) CheckIdentity(id Identity, password func(string) bool) (Identity, error) {
+	unchecked := false
+	for _, a := range auth {
+		checked, err := checkIdentity(a, id, password)
+		if err == nil {
+			return checked, nil
+		}
+		if err == errUncheckedIdentity {
+			unchecked = true
+		}
+	}
+	if unchecked {
+		return id, errUncheckedIdentity
+	}
+	return Identity{}, ErrInvalidCredentials
+}
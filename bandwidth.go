@@ -0,0 +1,114 @@
+package razproxy
+
+import (
+	"context"
+	"net"
+
+	"golang.org/x/time/rate"
+)
+
+// throttle limits the bandwidth of a connection by the bandwidth class of the user
+//
+// The connections of a user share the same limiter, so changing the class on
+// reload also affects the connections that are already open. Users without a
+// class get an unlimited limiter, which a reload may limit later.
+func (s *Server) throttle(user, policy string, conn net.Conn) net.Conn {
+	limit, burst := s.bandwidthSettings().limit(user, policy)
+
+	s.bandwidthMtx.Lock()
+	defer s.bandwidthMtx.Unlock()
+	ul, ok := s.bandwidth[user]
+	if !ok || ul.policy != policy {
+		ul = &userLimiter{Limiter: rate.NewLimiter(limit, burst), policy: policy}
+		s.bandwidth[user] = ul
+	}
+	return &throttledConn{Conn: conn, limiter: ul.Limiter}
+}
+
+// userLimiter is the bandwidth limiter of a user
+type userLimiter struct {
+	*rate.Limiter
+	policy string
+}
+
+// bandwidthSettings is a snapshot of the bandwidth settings of the server, so
+// the limits are computed without holding settingsMtx and bandwidthMtx at once
+type bandwidthSettings struct {
+	classes     map[string]int
+	userClasses map[string]string
+}
+
+func (s *Server) bandwidthSettings() bandwidthSettings {
+	s.settingsMtx.RLock()
+	defer s.settingsMtx.RUnlock()
+	return bandwidthSettings{classes: s.BandwidthClasses, userClasses: s.UserClasses}
+}
+
+// limit returns the limit of the bandwidth class of the user or its policy
+func (b bandwidthSettings) limit(user, policy string) (rate.Limit, int) {
+	class, ok := b.userClasses[user]
+	if !ok && len(policy) > 0 {
+		class, ok = b.userClasses["@"+policy]
+	}
+	if !ok {
+		class = b.userClasses["*"]
+	}
+	bytesPerSec := b.classes[class]
+	if bytesPerSec <= 0 {
+		return rate.Inf, 0
+	}
+	return rate.Limit(bytesPerSec), bytesPerSec
+}
+
+// updateBandwidth applies the bandwidth classes to the limiters of the users
+func (s *Server) updateBandwidth() {
+	settings := s.bandwidthSettings()
+
+	s.bandwidthMtx.Lock()
+	defer s.bandwidthMtx.Unlock()
+	for user, ul := range s.bandwidth {
+		limit, burst := settings.limit(user, ul.policy)
+		ul.SetBurst(burst)
+		ul.SetLimit(limit)
+	}
+}
+
+type throttledConn struct {
+	net.Conn
+	limiter *rate.Limiter
+}
+
+func (c *throttledConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.wait(n)
+	}
+	return n, err
+}
+
+func (c *throttledConn) Write(b []byte) (int, error) {
+	c.wait(len(b))
+	return c.Conn.Write(b)
+}
+
+// CloseWrite keeps half-closing working through the wrapper
+func (c *throttledConn) CloseWrite() error {
+	return closeWrite(c.Conn)
+}
+
+// wait blocks until n bytes are allowed, in chunks of at most the burst size
+func (c *throttledConn) wait(n int) {
+	for n > 0 {
+		if c.limiter.Limit() == rate.Inf {
+			return
+		}
+		chunk := n
+		if burst := c.limiter.Burst(); chunk > burst {
+			chunk = burst
+		}
+		if err := c.limiter.WaitN(context.Background(), chunk); err != nil {
+			return
+		}
+		n -= chunk
+	}
+}
@@ -0,0 +1,41 @@
+package razproxy
+
+import (
+	"io"
+	"log"
+	"net"
+	"testing"
+
+	"golang.org/x/time/rate"
+)
+
+func TestReloadBandwidth(t *testing.T) {
+	srv, err := NewServer(nil, nil, log.New(io.Discard, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	conn := srv.throttle("alice", "staff", server).(*throttledConn)
+	if conn.limiter.Limit() != rate.Inf {
+		t.Fatalf("expected no limit, got %v", conn.limiter.Limit())
+	}
+
+	// open connections of users without a class are limited once they get one
+	srv.Reload(nil, func(s *Server) {
+		s.BandwidthClasses = map[string]int{"slow": 1000}
+		s.UserClasses = map[string]string{"@staff": "slow"}
+	}, false)
+	if conn.limiter.Limit() != 1000 || conn.limiter.Burst() != 1000 {
+		t.Fatalf("expected a limit of 1000, got %v with burst %d", conn.limiter.Limit(), conn.limiter.Burst())
+	}
+
+	srv.Reload(nil, func(s *Server) {
+		s.UserClasses = nil
+	}, false)
+	if conn.limiter.Limit() != rate.Inf {
+		t.Fatalf("expected no limit, got %v", conn.limiter.Limit())
+	}
+}
@@ -0,0 +1,109 @@
+package razproxy
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// directOutbound dials destinations from the server, optionally binding
+// the connections to a source address, interface or firewall mark
+type directOutbound struct {
+	next    uint32
+	sources []net.IP
+	random  bool
+	iface   string
+	mark    int
+}
+
+// newDirectOutbound parses the binding options of a direct:// outbound URL:
+//
+//	source:    source IPs to rotate through (repeated or comma separated)
+//	rotate:    round-robin (default) or random
+//	interface: network interface to bind to (Linux only)
+//	fwmark:    firewall mark of the connections (Linux only)
+func newDirectOutbound(u *url.URL) (*directOutbound, error) {
+	q := u.Query()
+	o := &directOutbound{
+		iface: q.Get("interface"),
+	}
+	for _, sources := range q["source"] {
+		for _, source := range strings.Split(sources, ",") {
+			ip := net.ParseIP(strings.TrimSpace(source))
+			if ip == nil {
+				return nil, fmt.Errorf("invalid source IP: %s", source)
+			}
+			o.sources = append(o.sources, ip)
+		}
+	}
+	switch rotate := q.Get("rotate"); rotate {
+	case "", "round-robin":
+	case "random":
+		o.random = true
+	default:
+		return nil, fmt.Errorf("unknown rotation: %s", rotate)
+	}
+	if mark := q.Get("fwmark"); len(mark) > 0 {
+		var err error
+		o.mark, err = strconv.Atoi(mark)
+		if err != nil {
+			return nil, fmt.Errorf("invalid fwmark: %s", mark)
+		}
+	}
+	if (len(o.iface) > 0 || o.mark != 0) && !bindSupported {
+		return nil, fmt.Errorf("interface and fwmark binding are not supported on this platform")
+	}
+	return o, nil
+}
+
+func (o *directOutbound) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	dialer := &net.Dialer{
+		Timeout: 10 * time.Second,
+	}
+	if len(o.iface) > 0 || o.mark != 0 {
+		dialer.Control = func(network, address string, c syscall.RawConn) error {
+			return bindSocket(c, o.iface, o.mark)
+		}
+	}
+	if len(o.sources) > 0 {
+		source, err := o.pickSource(addr)
+		if err != nil {
+			return nil, err
+		}
+		dialer.LocalAddr = &net.TCPAddr{IP: source}
+	}
+	return dialer.DialContext(ctx, network, addr)
+}
+
+// pickSource returns the next source IP of the same address family as the destination
+func (o *directOutbound) pickSource(addr string) (net.IP, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	dest := net.ParseIP(host)
+	if dest == nil {
+		return nil, fmt.Errorf("source binding needs a resolved address: %s", addr)
+	}
+
+	var start int
+	if o.random {
+		start = rand.Intn(len(o.sources))
+	} else {
+		start = int(atomic.AddUint32(&o.next, 1) % uint32(len(o.sources)))
+	}
+	for i := range o.sources {
+		source := o.sources[(start+i)%len(o.sources)]
+		if (source.To4() != nil) == (dest.To4() != nil) {
+			return source, nil
+		}
+	}
+	return nil, fmt.Errorf("no source IP for %s", addr)
+}
@@ -0,0 +1,28 @@
+package razproxy
+
+import (
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+const bindSupported = true
+
+// bindSocket binds the socket to a network interface and sets its firewall mark
+func bindSocket(c syscall.RawConn, iface string, mark int) error {
+	var err error
+	ctrlErr := c.Control(func(fd uintptr) {
+		if len(iface) > 0 {
+			if err = unix.SetsockoptString(int(fd), unix.SOL_SOCKET, unix.SO_BINDTODEVICE, iface); err != nil {
+				return
+			}
+		}
+		if mark != 0 {
+			err = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_MARK, mark)
+		}
+	})
+	if ctrlErr != nil {
+		return ctrlErr
+	}
+	return err
+}
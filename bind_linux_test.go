@@ -0,0 +1,69 @@
+package razproxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/url"
+	"syscall"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func dialDirectTest(t *testing.T, rawurl, addr string) (net.Conn, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	o, err := newDirectOutbound(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return o.DialContext(context.Background(), "tcp", addr)
+}
+
+func TestDirectOutboundBind(t *testing.T) {
+	if !runInNetNS(t) {
+		return
+	}
+	addr := newTestEcho(t)
+
+	conn, err := dialDirectTest(t, "direct://?interface=lo&fwmark=42", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	rawConn, err := conn.(*net.TCPConn).SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var iface string
+	var mark int
+	rawConn.Control(func(fd uintptr) {
+		iface, err = unix.GetsockoptString(int(fd), unix.SOL_SOCKET, unix.SO_BINDTODEVICE)
+		if err == nil {
+			mark, err = unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_MARK)
+		}
+	})
+	if err != nil || iface != "lo" || mark != 42 {
+		t.Fatalf("expected lo with mark 42, got %q with mark %d, %v", iface, mark, err)
+	}
+
+	if _, err := dialDirectTest(t, "direct://?interface=razproxy-none", addr); err == nil {
+		t.Fatal("bound to a missing interface")
+	}
+
+	// marked connections are routed by the rules of their mark
+	ipTest(t, "rule", "add", "pref", "10", "fwmark", "42", "prohibit")
+	ipTest(t, "rule", "del", "pref", "0")
+	ipTest(t, "rule", "add", "pref", "20", "lookup", "local")
+	if _, err := dialDirectTest(t, "direct://?fwmark=42", addr); !errors.Is(err, syscall.EACCES) {
+		t.Fatalf("expected the marked connection to be prohibited, got %v", err)
+	}
+	conn, err = dialDirectTest(t, "direct://?fwmark=43", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+}
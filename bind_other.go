@@ -0,0 +1,14 @@
+//go:build !linux
+
+package razproxy
+
+import (
+	"fmt"
+	"syscall"
+)
+
+const bindSupported = false
+
+func bindSocket(c syscall.RawConn, iface string, mark int) error {
+	return fmt.Errorf("interface and fwmark binding are not supported on this platform")
+}
@@ -1,110 +1,230 @@
 package razproxy
 
 import (
-	"crypto/x509"
+	"errors"
 	"fmt"
 	"log"
 	"net"
+	"net/url"
 	"os"
 	"strconv"
-	"sync/atomic"
+	"sync"
 	"time"
+
+	"github.com/armon/go-socks5"
 )
 
 // ErrAuthFailed ...
 var ErrAuthFailed = fmt.Errorf("authentication failed")
 
+// AuthError is returned when the server rejects the credentials of the client
+//
+// It matches ErrAuthFailed with errors.Is, unless the server may accept the same
+// credentials later, e.g. after its authentication backend recovers.
+type AuthError struct {
+	Reason string
+	Retry  bool
+}
+
+func (e *AuthError) Error() string {
+	if len(e.Reason) == 0 {
+		return ErrAuthFailed.Error()
+	}
+	return ErrAuthFailed.Error() + ": " + e.Reason
+}
+
+// Is ...
+func (e *AuthError) Is(target error) bool {
+	return target == ErrAuthFailed && !e.Retry
+}
+
 // ClientConfig ...
 type ClientConfig struct {
-	User                 string
-	Password             string
-	SkipCertVerify       bool
-	PromptSkipCertVerify func() bool
+	User                  string
+	Password              string
+	SkipCertVerify        bool
+	Transport             string
+	Path                  string
+	HTTPProxy             string                 // URL of an HTTP CONNECT proxy to reach the servers through
+	Secret                string                 // pre-shared secret of the server
+	CredentialType        string                 // CredentialBearer, CredentialJWT or CredentialHMAC to log in with a token instead of a password
+	Credential            func() (string, error) // returns the token on every login, so it can be refreshed
+	PromptSkipCertVerify  func() bool
+	Router                *Router
+	Upstreams             []Upstream
+	Strategy              Strategy
+	HealthCheckInterval   time.Duration
+	PingTimeout           time.Duration
+	ReconnectMinDelay     time.Duration
+	ReconnectMaxDelay     time.Duration
+	ReconnectMaxAttempts  int           // 0 means unlimited
+	PendingTimeout        time.Duration // how long requests wait for a server to become available
+	OnEvent               func(ClientEvent)
+	Tunnel                *TunnelConfig
+	PoolSize              int // maximum number of parallel sessions per server
+	PoolStreamsPerSession int // number of streams after which a new session is opened
+	PoolBalance           PoolBalance
+	Reverse               []ReverseForward // services exposed through the servers
 }
 
 // Client ...
 type Client struct {
-	serverAddr   string
-	conf         *ClientConfig
-	Logger       *log.Logger
-	session      *clientSession
-	reconnecting int32 //bool
+	upstreams []*upstream
+	conf      *ClientConfig
+	Logger    *log.Logger
+	httpProxy *url.URL
+	next      uint32
+	stateMtx  sync.Mutex
+	stateCh   chan struct{}
 }
 
 // NewClient returns a new Client
+//
+// The client connects to serverAddr using the credentials in conf, and to any
+// additional servers listed in conf.Upstreams. It only fails if none of the
+// servers are reachable.
 func NewClient(serverAddr string, conf *ClientConfig) (*Client, error) {
-	if _, port, _ := net.SplitHostPort(serverAddr); len(port) == 0 {
-		serverAddr += ":9820"
-	}
-
 	if conf == nil {
 		conf = &ClientConfig{}
 	}
+	if conf.HealthCheckInterval == 0 {
+		conf.HealthCheckInterval = 30 * time.Second
+	}
+	if conf.PingTimeout == 0 {
+		conf.PingTimeout = 10 * time.Second
+	}
+	if conf.ReconnectMinDelay == 0 {
+		conf.ReconnectMinDelay = time.Second
+	}
+	if conf.ReconnectMaxDelay < conf.ReconnectMinDelay {
+		conf.ReconnectMaxDelay = max(time.Minute, conf.ReconnectMinDelay)
+	}
+	if conf.PoolStreamsPerSession == 0 {
+		conf.PoolStreamsPerSession = 8
+	}
+	if conf.PendingTimeout == 0 {
+		conf.PendingTimeout = 30 * time.Second
+	}
+	switch conf.Strategy {
+	case "", StrategyFailover, StrategyRoundRobin, StrategyLeastLatency, StrategySticky:
+	default:
+		return nil, fmt.Errorf("unknown strategy: %s", conf.Strategy)
+	}
 
 	c := &Client{
-		serverAddr: serverAddr,
-		conf:       conf,
-		Logger:     log.New(os.Stdout, "", log.LstdFlags),
+		conf:    conf,
+		Logger:  log.New(os.Stdout, "", log.LstdFlags),
+		stateCh: make(chan struct{}),
 	}
-	err := c.connect()
-	if err != nil {
-		return nil, err
+	if len(conf.HTTPProxy) > 0 {
+		proxyURL, err := url.Parse(conf.HTTPProxy)
+		if err != nil {
+			return nil, err
+		}
+		c.httpProxy = proxyURL
 	}
 
-	return c, nil
-}
+	upstreams := conf.Upstreams
+	if len(serverAddr) > 0 {
+		upstreams = append([]Upstream{{
+			Addr:           serverAddr,
+			User:           conf.User,
+			Password:       conf.Password,
+			SkipCertVerify: conf.SkipCertVerify,
+			Transport:      conf.Transport,
+			Path:           conf.Path,
+			Secret:         conf.Secret,
+			CredentialType: conf.CredentialType,
+			Credential:     conf.Credential,
+		}}, upstreams...)
+	}
+	if len(upstreams) == 0 {
+		return nil, fmt.Errorf("no server address")
+	}
 
-func (c *Client) connect() error {
-	session, err := c.newSession()
-	if err != nil {
-		if _, certErr := err.(x509.UnknownAuthorityError); !certErr || c.conf.PromptSkipCertVerify == nil {
-			return err
-		}
-		cont := c.conf.PromptSkipCertVerify()
-		if cont {
-			c.conf.SkipCertVerify = true
-			session, err = c.newSession()
-			if err != nil {
-				return err
+	var firstErr error
+	var failed []*upstream
+	for _, conf := range upstreams {
+		u := newUpstream(c, conf)
+		if err := u.connect(); err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			if errors.Is(err, ErrAuthFailed) {
+				u.setState(StateFailed, 0, err)
+			} else {
+				failed = append(failed, u)
 			}
-		} else {
-			return err
 		}
+		c.upstreams = append(c.upstreams, u)
+	}
+	if len(c.pick(nil)) == 0 {
+		return nil, firstErr
 	}
 
-	c.session = session
-	atomic.StoreInt32(&c.reconnecting, 0)
-	c.Logger.Println("connected as", session.id)
-	return nil
+	for _, u := range failed {
+		go u.reconnect()
+	}
+	for _, u := range c.upstreams {
+		go u.healthCheck(conf.HealthCheckInterval)
+	}
+	return c, nil
 }
 
 func (c *Client) proxy(conn net.Conn) error {
-	for atomic.LoadInt32(&c.reconnecting) != 0 {
-		time.Sleep(time.Second)
+	dest, err := readSocksRequest(conn)
+	if err != nil {
+		return err
 	}
 
-	err := c.session.proxy(conn)
+	var remote net.Conn
+	switch action := c.route(dest); action {
+	case ActionProxy:
+		remote, err = c.dial(dest)
+	case ActionDirect:
+		remote, err = net.Dial("tcp", dest.Address())
+	case ActionReject:
+		return writeSocksReply(conn, ruleFailure)
+	default:
+		writeSocksReply(conn, ruleFailure)
+		return fmt.Errorf("unknown action: %s", action)
+	}
 	if err != nil {
-		if !atomic.CompareAndSwapInt32(&c.reconnecting, 0, 1) {
-			return err
+		writeSocksReply(conn, socksReplyCode(err))
+		return err
+	}
+	defer remote.Close()
+
+	if err := writeSocksReply(conn, successReply); err != nil {
+		return err
+	}
+	return relay(conn, remote)
+}
+
+func (c *Client) route(dest *socks5.AddrSpec) Action {
+	if c.conf.Router == nil {
+		return ActionProxy
+	}
+	return c.conf.Router.Route(dest)
+}
+
+func (c *Client) dial(dest *socks5.AddrSpec) (net.Conn, error) {
+	deadline := time.Now().Add(c.conf.PendingTimeout)
+	for {
+		upstreams, err := c.waitUpstreams(dest, deadline)
+		if err != nil {
+			return nil, err
 		}
-		c.session.Close()
-		c.Logger.Println("disconnected")
-		go func() {
-			for {
-				time.Sleep(time.Second)
-				c.Logger.Println("reconnecting..")
-				switch c.connect() {
-				case nil:
-					return
-				case ErrAuthFailed:
-					c.Logger.Println(ErrAuthFailed)
-					return
-				}
+		for _, u := range upstreams {
+			conn, err := u.dial(dest)
+			if err == nil {
+				return conn, nil
 			}
-		}()
+			if _, ok := err.(SocksError); ok {
+				return nil, err
+			}
+		}
 	}
-	return err
 }
 
 // ListenAndServe opens a local SOCKS5 port that listens to and transmits requests to the server
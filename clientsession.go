@@ -2,96 +2,226 @@ package razproxy
 
 import (
 	"crypto/tls"
-	"io"
+	"errors"
+	"fmt"
 	"net"
 	"net/rpc"
+	"sync/atomic"
+	"time"
 
-	"github.com/xtaci/smux"
+	"github.com/armon/go-socks5"
 )
 
 type clientSession struct {
+	pingSeq uint64
 	id      string
-	session *smux.Session
+	session tunnel
+	control controlClient
+	idle    bool
 }
 
-func (c *Client) newSession() (s *clientSession, err error) {
-	tlsConf := &tls.Config{
-		InsecureSkipVerify: c.conf.SkipCertVerify,
-	}
-	tlsConf.ServerName, _, _ = net.SplitHostPort(c.serverAddr)
-	conn, err := tls.Dial("tcp", c.serverAddr, tlsConf)
+func (u *upstream) newSession(join string) (s *clientSession, err error) {
+	session, err := u.dialTunnel()
 	if err != nil {
 		return nil, err
 	}
 
 	defer func() {
 		if err != nil {
-			conn.Close()
+			session.Close()
 		}
 	}()
 
-	session, err := smux.Client(conn, nil)
+	controlConn, err := session.OpenStream()
 	if err != nil {
 		return
 	}
-
-	rpcConn, err := session.OpenStream()
+	control, err := u.newControl(controlConn)
+	if err == errLegacyServer {
+		session.Close()
+		return u.newSession(join)
+	}
 	if err != nil {
 		return
 	}
 
-	rpcClient := rpc.NewClient(rpcConn)
 	authReq := &AuthRequest{
-		User:     c.conf.User,
-		Password: c.conf.Password,
+		User:     u.User,
+		Password: u.Password,
+		Join:     join,
+	}
+	if len(join) == 0 && control.has(FeatureSessionToken) {
+		authReq.Token = u.getToken()
+	}
+	if u.Credential != nil {
+		if !control.has(FeatureTokenCredentials) {
+			return nil, fmt.Errorf("server does not support token credentials")
+		}
+		authReq.CredentialType = u.CredentialType
+		authReq.Credential, err = u.Credential()
+		if err != nil {
+			return
+		}
 	}
 	authRes := new(AuthResult)
-	err = rpcClient.Call("RPC.Auth", authReq, authRes)
+	err = control.call("auth", authReq, authRes)
+	var controlErr *ControlError
+	if errors.As(err, &controlErr) && (controlErr.Code == ErrCodeAuthFailed || controlErr.Code == ErrCodeAuthUnavailable) {
+		return nil, &AuthError{Reason: controlErr.Message, Retry: controlErr.Code == ErrCodeAuthUnavailable}
+	}
 	if err != nil {
 		return
 	}
 	if !authRes.OK {
-		return nil, ErrAuthFailed
+		return nil, &AuthError{Reason: authRes.Reason, Retry: authRes.Retry}
+	}
+	if len(join) == 0 {
+		u.setToken(authRes.Token)
 	}
 
 	return &clientSession{
 		id:      authRes.ID,
 		session: session,
+		control: control,
 	}, nil
 }
 
-func (s *clientSession) proxy(conn net.Conn) error {
-	stream, err := s.session.OpenStream()
+// newControl starts the control protocol on conn, or the net/rpc protocol if
+// the server turned out to be older
+func (u *upstream) newControl(conn net.Conn) (controlClient, error) {
+	if atomic.LoadInt32(&u.legacyControl) == 1 {
+		return legacyControl{rpc.NewClient(conn)}, nil
+	}
+	c, err := newControlClient(conn)
 	if err != nil {
-		return err
+		if err == errLegacyServer && atomic.CompareAndSwapInt32(&u.legacyControl, 0, 1) {
+			u.client.Logger.Println(u.Addr, "is an older server, falling back to the legacy control protocol")
+		}
+		return nil, err
+	}
+	return c, nil
+}
+
+// dialTunnel connects to the server using the configured transport
+// and falls back to TLS if QUIC is unavailable
+//
+// QUIC is skipped if an HTTP proxy is configured, because it cannot tunnel UDP.
+func (u *upstream) dialTunnel() (tunnel, error) {
+	tlsConf := &tls.Config{
+		InsecureSkipVerify: atomic.LoadInt32(&u.skipCertVerify) == 1,
+		NextProtos:         []string{razproxyALPN},
+		ClientSessionCache: u.tlsSessions,
 	}
-	defer stream.Close()
+	tlsConf.ServerName, _, _ = net.SplitHostPort(u.Addr)
 
-	isExpectedErr := func(e error) bool {
-		if e == io.ErrClosedPipe || e == io.EOF {
-			return true
+	if u.Transport == TransportQUIC && u.client.httpProxy == nil {
+		t, err := dialQUIC(u.Addr, tlsConf, u.client.conf.Tunnel, u.Secret)
+		if err == nil {
+			return t, nil
 		}
-		if e, ok := e.(*net.OpError); ok && e.Source == conn.LocalAddr() {
-			return true
+		u.client.Logger.Println("QUIC unavailable for", u.Addr+", falling back to TLS:", err)
+	}
+
+	dialer := u.Dialer
+	if dialer == nil {
+		name := u.Transport
+		if len(name) == 0 || name == TransportQUIC {
+			name = TransportTLS
 		}
-		return false
-	}
-
-	errCh := make(chan error, 2)
-	go proxy(stream, conn, errCh)
-	go proxy(conn, stream, errCh)
-	for i := 0; i < 2; i++ {
-		if e := <-errCh; e != nil {
-			if isExpectedErr(e) {
-				return nil
-			}
-			return e
+		t, err := getTransport(name)
+		if err != nil {
+			return nil, err
+		}
+		dialer, err = t.NewDialer(&TransportConfig{
+			TLS:       tlsConf,
+			Path:      u.Path,
+			HTTPProxy: u.client.httpProxy,
+		})
+		if err != nil {
+			return nil, err
 		}
 	}
-	return nil
+
+	conn, err := dialer.Dial(u.Addr)
+	if err != nil {
+		return nil, err
+	}
+	if len(u.Secret) > 0 {
+		if _, err := conn.Write(secretToken(u.Secret)); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	t, err := newSmuxTunnel(conn, u.client.conf.Tunnel, false)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return t, nil
+}
+
+// getToken returns the session token of the last primary session
+func (u *upstream) getToken() string {
+	u.mtx.RLock()
+	defer u.mtx.RUnlock()
+	return u.token
+}
+
+func (u *upstream) setToken(token string) {
+	u.mtx.Lock()
+	defer u.mtx.Unlock()
+	u.token = token
+}
+
+func (s *clientSession) dial(dest *socks5.AddrSpec) (net.Conn, error) {
+	stream, err := s.session.OpenStream()
+	if err != nil {
+		return nil, err
+	}
+	if err := socksConnect(stream, dest); err != nil {
+		stream.Close()
+		return nil, err
+	}
+	return stream, nil
+}
+
+// load returns the number of proxied streams (not counting the control stream)
+func (s *clientSession) load() int {
+	return s.session.NumStreams() - 1
+}
+
+// ping measures the round-trip time of a ping request
+func (s *clientSession) ping(timeout time.Duration) (time.Duration, error) {
+	req := &PingRequest{Seq: atomic.AddUint64(&s.pingSeq, 1)}
+	res := new(PingResult)
+	start := time.Now()
+	done := make(chan error, 1)
+	go func() {
+		done <- s.control.call("ping", req, res)
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			return 0, err
+		}
+		if res.Seq != req.Seq {
+			return 0, fmt.Errorf("ping sequence mismatch")
+		}
+		return time.Since(start), nil
+	case <-time.After(timeout):
+		return 0, fmt.Errorf("ping timeout")
+	}
+}
+
+// isLegacy returns whether the session speaks the net/rpc control protocol of older servers
+func (s *clientSession) isLegacy() bool {
+	_, ok := s.control.(legacyControl)
+	return ok
 }
 
 // Close ...
 func (s *clientSession) Close() error {
+	s.control.Close()
 	return s.session.Close()
 }
@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"flag"
 	"fmt"
+	"log"
 	"os"
 	"strconv"
 	"strings"
@@ -15,27 +16,189 @@ import (
 
 // command line args
 var (
+	ConfigFile    string
 	ServerAddr    string
 	LocalPort     int
 	User          string
 	Password      string
 	SkipTLSVerify bool
+	RulesFile     string
+	Strategy      string
+	MaxRetries    int
+	SmuxVersion   int
+	KeepAlive     time.Duration
+	PoolSize      int
+	Transport     string
+	WSPath        string
+	HTTPProxy     string
+	Secret        string
+	Reverse       string
+	Forwards      string
+	Transparent   string
+	TProxy        bool
+	Tun           string
+	TunAddr       string
+	Token         string
+	TokenType     string
+	OIDCIssuer    string
+	OIDCClientID  string
+	OIDCScope     string
 )
 
+// only available in the config file
+var Upstreams []razproxy.Upstream
+
+// fileConfig is the format of the config file, with the same names as the command line args
+type fileConfig struct {
+	Addr          []string            `json:"addr"`
+	Upstreams     []razproxy.Upstream `json:"upstreams"`
+	Port          int                 `json:"port"`
+	User          string              `json:"user"`
+	Password      string              `json:"pw"`
+	SkipTLSVerify bool                `json:"skip-tls-verify"`
+	Rules         string              `json:"rules"`
+	Strategy      string              `json:"strategy"`
+	Retries       int                 `json:"retries"`
+	Smux          int                 `json:"smux"`
+	KeepAlive     razproxy.Duration   `json:"keepalive"`
+	Pool          int                 `json:"pool"`
+	Transport     string              `json:"transport"`
+	Path          string              `json:"path"`
+	HTTPProxy     string              `json:"http-proxy"`
+	Secret        string              `json:"secret"`
+	Reverse       []string            `json:"R"`
+	Forwards      []string            `json:"L"`
+	Transparent   string              `json:"transparent"`
+	TProxy        bool                `json:"tproxy"`
+	Tun           string              `json:"tun"`
+	TunAddr       string              `json:"tun-addr"`
+	Token         string              `json:"token"`
+	TokenType     string              `json:"token-type"`
+	OIDCIssuer    string              `json:"oidc-issuer"`
+	OIDCClientID  string              `json:"oidc-client-id"`
+	OIDCScope     string              `json:"oidc-scope"`
+}
+
 func init() {
-	flag.StringVar(&ServerAddr, "addr", "", "Server address/hostname")
+	flag.StringVar(&ConfigFile, "config", "", "JSON config file path (command line args override the file)")
+	flag.StringVar(&ServerAddr, "addr", "", "Server address/hostname (comma separated list for multiple servers)")
 	flag.IntVar(&LocalPort, "port", 1080, "Local SOCKS5 port")
 	flag.StringVar(&User, "user", "", "Username for auth")
 	flag.StringVar(&Password, "pw", "", "Password for auth")
 	flag.BoolVar(&SkipTLSVerify, "skip-tls-verify", false, "Skip TLC cert verification")
+	flag.StringVar(&RulesFile, "rules", "", "Routing rules file path")
+	flag.IntVar(&MaxRetries, "retries", 0, "Maximum number of reconnect attempts (0 = unlimited)")
+	flag.StringVar(&Strategy, "strategy", "failover", "Server selection strategy (failover, round-robin, least-latency, sticky)")
+	flag.IntVar(&SmuxVersion, "smux", 1, "smux protocol version (must match the server)")
+	flag.DurationVar(&KeepAlive, "keepalive", 10*time.Second, "Keepalive interval")
+	flag.IntVar(&PoolSize, "pool", 1, "Maximum number of parallel sessions per server")
+	flag.StringVar(&Transport, "transport", razproxy.TransportTLS, "Transport protocol (tls, quic, ws, tcp or unix)")
+	flag.StringVar(&WSPath, "path", "/", "WebSocket path on the server")
+	flag.StringVar(&HTTPProxy, "http-proxy", "", "HTTP CONNECT proxy URL (http://user:pw@host:port)")
+	flag.StringVar(&Secret, "secret", "", "Pre-shared secret of the server")
+	flag.StringVar(&Reverse, "R", "", "Comma separated list of reverse tunnels (remote_addr=local_addr, e.g. :8080=localhost:3000)")
+	flag.StringVar(&Forwards, "L", "", "Comma separated list of local TCP forwards ([bind_address:]port:host:hostport)")
+	flag.StringVar(&Transparent, "transparent", "", "Accept connections redirected by iptables/nftables on this address (Linux only)")
+	flag.BoolVar(&TProxy, "tproxy", false, "Expect TPROXY instead of REDIRECT in transparent mode")
+	flag.StringVar(&Tun, "tun", "", "Create a TUN interface with this name and tunnel the TCP connections routed to it (Linux only)")
+	flag.StringVar(&TunAddr, "tun-addr", "198.18.0.1/15", "Address of the TUN interface, which is also the range of fake DNS answers")
+	flag.StringVar(&Token, "token", "", "Log in with a token instead of user and password")
+	flag.StringVar(&TokenType, "token-type", razproxy.CredentialBearer, "Type of the token (bearer, jwt or hmac)")
+	flag.StringVar(&OIDCIssuer, "oidc-issuer", "", "Log in at this OpenID Connect identity provider with a device code and send its JWTs")
+	flag.StringVar(&OIDCClientID, "oidc-client-id", "", "OAuth2 client ID of razproxy at the identity provider")
+	flag.StringVar(&OIDCScope, "oidc-scope", "openid offline_access", "OAuth2 scopes to request")
 	flag.Parse()
+
+	if len(ConfigFile) > 0 {
+		if err := loadConfig(ConfigFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+// loadConfig sets the args that are not given on the command line from the config file
+func loadConfig(file string) error {
+	var conf fileConfig
+	if err := razproxy.LoadConfig(file, &conf); err != nil {
+		return err
+	}
+
+	values := map[string]string{
+		"addr":           strings.Join(conf.Addr, ","),
+		"user":           conf.User,
+		"pw":             conf.Password,
+		"rules":          conf.Rules,
+		"strategy":       conf.Strategy,
+		"transport":      conf.Transport,
+		"path":           conf.Path,
+		"http-proxy":     conf.HTTPProxy,
+		"secret":         conf.Secret,
+		"R":              strings.Join(conf.Reverse, ","),
+		"L":              strings.Join(conf.Forwards, ","),
+		"transparent":    conf.Transparent,
+		"tun":            conf.Tun,
+		"tun-addr":       conf.TunAddr,
+		"token":          conf.Token,
+		"token-type":     conf.TokenType,
+		"oidc-issuer":    conf.OIDCIssuer,
+		"oidc-client-id": conf.OIDCClientID,
+		"oidc-scope":     conf.OIDCScope,
+	}
+	for name, value := range map[string]int{
+		"port":    conf.Port,
+		"retries": conf.Retries,
+		"smux":    conf.Smux,
+		"pool":    conf.Pool,
+	} {
+		if value != 0 {
+			values[name] = strconv.Itoa(value)
+		}
+	}
+	if conf.SkipTLSVerify {
+		values["skip-tls-verify"] = "true"
+	}
+	if conf.KeepAlive != 0 {
+		values["keepalive"] = time.Duration(conf.KeepAlive).String()
+	}
+	if conf.TProxy {
+		values["tproxy"] = "true"
+	}
+
+	given := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+	})
+	for name, value := range values {
+		if given[name] || len(value) == 0 {
+			continue
+		}
+		if err := flag.Set(name, value); err != nil {
+			return fmt.Errorf("%s: %s: %w", file, name, err)
+		}
+	}
+
+	Upstreams = conf.Upstreams
+	return nil
 }
 
 func main() {
 	cfg := &razproxy.ClientConfig{
-		User:           User,
-		Password:       Password,
-		SkipCertVerify: SkipTLSVerify,
+		User:                 User,
+		Password:             Password,
+		SkipCertVerify:       SkipTLSVerify,
+		Transport:            Transport,
+		Path:                 WSPath,
+		HTTPProxy:            HTTPProxy,
+		Secret:               Secret,
+		Strategy:             razproxy.Strategy(Strategy),
+		ReconnectMaxAttempts: MaxRetries,
+		HealthCheckInterval:  KeepAlive,
+		PoolSize:             PoolSize,
+		Tunnel: &razproxy.TunnelConfig{
+			Version:           SmuxVersion,
+			KeepAliveInterval: KeepAlive,
+			KeepAliveTimeout:  3 * KeepAlive,
+		},
 	}
 
 	if len(os.Args) == 1 {
@@ -77,16 +240,109 @@ func main() {
 		}
 	}
 
-	if len(ServerAddr) == 0 {
+	if len(OIDCIssuer) > 0 {
+		login, err := newOIDCLogin(OIDCIssuer, OIDCClientID, OIDCScope)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		cfg.CredentialType = razproxy.CredentialJWT
+		cfg.Credential = login.Token
+	} else if len(Token) > 0 {
+		cfg.CredentialType = TokenType
+		cfg.Credential = func() (string, error) {
+			return Token, nil
+		}
+	}
+
+	if len(ServerAddr) == 0 && len(Upstreams) == 0 {
 		ServerAddr = "localhost"
 	}
 
-	c, err := razproxy.NewClient(ServerAddr, cfg)
+	if len(RulesFile) > 0 {
+		router, err := razproxy.LoadRouter(RulesFile, log.New(os.Stdout, "", log.LstdFlags))
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		cfg.Router = router
+	}
+
+	if len(Reverse) > 0 {
+		for _, r := range strings.Split(Reverse, ",") {
+			remote, local, ok := strings.Cut(strings.TrimSpace(r), "=")
+			if !ok {
+				fmt.Println("invalid reverse tunnel:", r)
+				return
+			}
+			cfg.Reverse = append(cfg.Reverse, razproxy.ReverseForward{Remote: remote, Local: local})
+		}
+	}
+
+	var forwards []razproxy.LocalForward
+	if len(Forwards) > 0 {
+		for _, f := range strings.Split(Forwards, ",") {
+			forward, err := razproxy.ParseLocalForward(strings.TrimSpace(f))
+			if err != nil {
+				fmt.Println(err)
+				return
+			}
+			forwards = append(forwards, forward)
+		}
+	}
+
+	var servers []string
+	if len(ServerAddr) > 0 {
+		servers = strings.Split(ServerAddr, ",")
+	} else {
+		servers = []string{""} // only the upstreams of the config file
+	}
+	for _, addr := range servers[1:] {
+		cfg.Upstreams = append(cfg.Upstreams, razproxy.Upstream{
+			Addr:           addr,
+			User:           User,
+			Password:       Password,
+			SkipCertVerify: SkipTLSVerify,
+			Transport:      Transport,
+			Path:           WSPath,
+			Secret:         Secret,
+			CredentialType: cfg.CredentialType,
+			Credential:     cfg.Credential,
+		})
+	}
+
+	cfg.Upstreams = append(cfg.Upstreams, Upstreams...)
+
+	c, err := razproxy.NewClient(servers[0], cfg)
 	if err != nil {
 		fmt.Println(err)
 		return
 	}
 
+	for _, f := range forwards {
+		go func(f razproxy.LocalForward) {
+			if err := c.ListenAndForward(f); err != nil {
+				log.Fatal(err)
+			}
+		}(f)
+	}
+
+	if len(Transparent) > 0 {
+		go func() {
+			if err := c.ListenAndServeTransparent(Transparent, TProxy); err != nil {
+				log.Fatal(err)
+			}
+		}()
+	}
+
+	if len(Tun) > 0 {
+		go func() {
+			if err := c.ListenAndServeTun(&razproxy.TunConfig{Name: Tun, Addr: TunAddr}); err != nil {
+				log.Fatal(err)
+			}
+		}()
+	}
+
 	if err := c.ListenAndServe(uint16(LocalPort)); err != nil {
 		fmt.Println(err)
 		return
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// oidcLogin obtains tokens from an identity provider with the OAuth2 device
+// authorization grant (RFC 8628) and caches them, so the user only has to log
+// in again when the refresh token is no longer accepted
+type oidcLogin struct {
+	issuer         string
+	clientID       string
+	scope          string
+	cacheFile      string
+	deviceEndpoint string
+	tokenEndpoint  string
+	mtx            sync.Mutex
+	cached         *cachedToken
+}
+
+type cachedToken struct {
+	Issuer       string    `json:"issuer"`
+	ClientID     string    `json:"client_id"`
+	AccessToken  string    `json:"access_token"`
+	IDToken      string    `json:"id_token"`
+	RefreshToken string    `json:"refresh_token"`
+	Expiry       time.Time `json:"expiry"`
+}
+
+type tokenResponse struct {
+	AccessToken      string `json:"access_token"`
+	IDToken          string `json:"id_token"`
+	RefreshToken     string `json:"refresh_token"`
+	ExpiresIn        int    `json:"expires_in"`
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+type deviceResponse struct {
+	DeviceCode              string `json:"device_code"`
+	UserCode                string `json:"user_code"`
+	VerificationURI         string `json:"verification_uri"`
+	VerificationURIComplete string `json:"verification_uri_complete"`
+	ExpiresIn               int    `json:"expires_in"`
+	Interval                int    `json:"interval"`
+}
+
+var httpClient = &http.Client{Timeout: 30 * time.Second}
+
+func newOIDCLogin(issuer, clientID, scope string) (*oidcLogin, error) {
+	var discovery struct {
+		DeviceEndpoint string `json:"device_authorization_endpoint"`
+		TokenEndpoint  string `json:"token_endpoint"`
+	}
+	resp, err := httpClient.Get(strings.TrimSuffix(issuer, "/") + "/.well-known/openid-configuration")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("OIDC discovery error: %s", resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&discovery); err != nil {
+		return nil, err
+	}
+	if len(discovery.DeviceEndpoint) == 0 {
+		return nil, fmt.Errorf("identity provider does not support the device authorization grant")
+	}
+
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		cacheDir = os.TempDir()
+	}
+	return &oidcLogin{
+		issuer:         issuer,
+		clientID:       clientID,
+		scope:          scope,
+		cacheFile:      filepath.Join(cacheDir, "razproxy", "oidc-token.json"),
+		deviceEndpoint: discovery.DeviceEndpoint,
+		tokenEndpoint:  discovery.TokenEndpoint,
+	}, nil
+}
+
+// Token returns a valid token, refreshing it or logging in if needed
+//
+// The ID token is preferred, as its audience is the client ID that the server can check.
+func (l *oidcLogin) Token() (string, error) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	if l.cached == nil {
+		l.cached = l.loadCache()
+	}
+	if t := l.cached; t != nil && time.Now().Add(time.Minute).Before(t.Expiry) {
+		return t.token(), nil
+	}
+	if t := l.cached; t != nil && len(t.RefreshToken) > 0 {
+		resp, err := l.requestToken(url.Values{
+			"grant_type":    {"refresh_token"},
+			"refresh_token": {t.RefreshToken},
+		})
+		if err == nil {
+			return l.save(resp), nil
+		}
+		fmt.Println("Token refresh failed, logging in again:", err)
+	}
+
+	resp, err := l.deviceLogin()
+	if err != nil {
+		return "", err
+	}
+	return l.save(resp), nil
+}
+
+func (l *oidcLogin) deviceLogin() (*tokenResponse, error) {
+	httpResp, err := httpClient.PostForm(l.deviceEndpoint, url.Values{
+		"client_id": {l.clientID},
+		"scope":     {l.scope},
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer httpResp.Body.Close()
+	if httpResp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("device authorization error: %s", httpResp.Status)
+	}
+	var device deviceResponse
+	if err := json.NewDecoder(httpResp.Body).Decode(&device); err != nil {
+		return nil, err
+	}
+
+	if len(device.VerificationURIComplete) > 0 {
+		fmt.Println("To log in, visit", device.VerificationURIComplete)
+	} else {
+		fmt.Println("To log in, visit", device.VerificationURI, "and enter the code", device.UserCode)
+	}
+
+	interval := time.Duration(device.Interval) * time.Second
+	if interval == 0 {
+		interval = 5 * time.Second
+	}
+	deadline := time.Now().Add(time.Duration(device.ExpiresIn) * time.Second)
+	for time.Now().Before(deadline) {
+		time.Sleep(interval)
+		resp, err := l.requestToken(url.Values{
+			"grant_type":  {"urn:ietf:params:oauth:grant-type:device_code"},
+			"device_code": {device.DeviceCode},
+		})
+		if err == nil {
+			return resp, nil
+		}
+		switch resp.Error {
+		case "authorization_pending":
+		case "slow_down":
+			interval += 5 * time.Second
+		default:
+			return nil, err
+		}
+	}
+	return nil, fmt.Errorf("device login expired")
+}
+
+// requestToken calls the token endpoint and returns the response, which contains the error code on failure
+func (l *oidcLogin) requestToken(params url.Values) (*tokenResponse, error) {
+	params.Set("client_id", l.clientID)
+	httpResp, err := httpClient.PostForm(l.tokenEndpoint, params)
+	if err != nil {
+		return &tokenResponse{}, err
+	}
+	defer httpResp.Body.Close()
+
+	resp := new(tokenResponse)
+	if err := json.NewDecoder(httpResp.Body).Decode(resp); err != nil {
+		return resp, fmt.Errorf("token endpoint error: %s", httpResp.Status)
+	}
+	if len(resp.Error) > 0 {
+		return resp, fmt.Errorf("token endpoint error: %s %s", resp.Error, resp.ErrorDescription)
+	}
+	if len(resp.AccessToken) == 0 && len(resp.IDToken) == 0 {
+		return resp, fmt.Errorf("token endpoint returned no token")
+	}
+	return resp, nil
+}
+
+func (l *oidcLogin) save(resp *tokenResponse) string {
+	t := &cachedToken{
+		Issuer:       l.issuer,
+		ClientID:     l.clientID,
+		AccessToken:  resp.AccessToken,
+		IDToken:      resp.IDToken,
+		RefreshToken: resp.RefreshToken,
+		Expiry:       time.Now().Add(time.Duration(resp.ExpiresIn) * time.Second),
+	}
+	if len(t.RefreshToken) == 0 && l.cached != nil {
+		t.RefreshToken = l.cached.RefreshToken // refresh tokens are not always rotated
+	}
+	l.cached = t
+
+	if data, err := json.Marshal(t); err == nil {
+		os.MkdirAll(filepath.Dir(l.cacheFile), 0700)
+		if err := os.WriteFile(l.cacheFile, data, 0600); err != nil {
+			fmt.Println("Cannot cache token:", err)
+		}
+	}
+	return t.token()
+}
+
+func (l *oidcLogin) loadCache() *cachedToken {
+	data, err := os.ReadFile(l.cacheFile)
+	if err != nil {
+		return nil
+	}
+	t := new(cachedToken)
+	if json.Unmarshal(data, t) != nil || t.Issuer != l.issuer || t.ClientID != l.clientID {
+		return nil
+	}
+	return t
+}
+
+func (t *cachedToken) token() string {
+	if len(t.IDToken) > 0 {
+		return t.IDToken
+	}
+	return t.AccessToken
+}
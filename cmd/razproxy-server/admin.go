@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/razzie/razproxy"
+)
+
+// subcommands are run instead of the server, e.g. razproxy-server admin sessions
+var subcommands = map[string]func(args []string) error{
+	"admin":      adminCommand,
+	"hmac-token": hmacTokenCommand,
+}
+
+func subcommand() func(args []string) error {
+	if len(os.Args) > 1 {
+		return subcommands[os.Args[1]]
+	}
+	return nil
+}
+
+// adminCommand calls the admin API of a running server and prints the result
+func adminCommand(args []string) error {
+	fs := flag.NewFlagSet("admin", flag.ExitOnError)
+	addr := fs.String("addr", "127.0.0.1:9821", "Admin API address")
+	token := fs.String("token", os.Getenv("RAZPROXY_ADMIN_TOKEN"), "Admin API token (defaults to $RAZPROXY_ADMIN_TOKEN)")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: razproxy-server admin [flags] <command>")
+		fmt.Fprintln(fs.Output(), "Commands:")
+		fmt.Fprintln(fs.Output(), "  sessions          list sessions")
+		fmt.Fprintln(fs.Output(), "  streams <id>      list the proxied connections of a session")
+		fmt.Fprintln(fs.Output(), "  kick <id>         close a session")
+		fmt.Fprintln(fs.Output(), "  kick-user <user>  close the sessions of a user")
+		fmt.Fprintln(fs.Output(), "  flush-dns         flush the DNS caches")
+		fmt.Fprintln(fs.Output(), "  ratelimits        dump the rate limiter state")
+		fmt.Fprintln(fs.Output(), "  reload            reload the config file")
+		fmt.Fprintln(fs.Output(), "Flags:")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	var method, path string
+	switch cmd := fs.Arg(0); {
+	case cmd == "sessions" && fs.NArg() == 1:
+		method, path = http.MethodGet, "/sessions"
+	case cmd == "streams" && fs.NArg() == 2:
+		method, path = http.MethodGet, "/sessions/"+url.PathEscape(fs.Arg(1))+"/streams"
+	case cmd == "kick" && fs.NArg() == 2:
+		method, path = http.MethodDelete, "/sessions/"+url.PathEscape(fs.Arg(1))
+	case cmd == "kick-user" && fs.NArg() == 2:
+		method, path = http.MethodDelete, "/users/"+url.PathEscape(fs.Arg(1))
+	case cmd == "flush-dns" && fs.NArg() == 1:
+		method, path = http.MethodPost, "/dns/flush"
+	case cmd == "ratelimits" && fs.NArg() == 1:
+		method, path = http.MethodGet, "/ratelimits"
+	case cmd == "reload" && fs.NArg() == 1:
+		method, path = http.MethodPost, "/reload"
+	default:
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	req, err := http.NewRequest(method, "http://"+*addr+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+*token)
+	resp, err := (&http.Client{Timeout: 10 * time.Second}).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		var result struct{ Error string }
+		if json.Unmarshal(body, &result) == nil && len(result.Error) > 0 {
+			return fmt.Errorf("admin API error: %s", result.Error)
+		}
+		return fmt.Errorf("admin API error: %s", resp.Status)
+	}
+	var out bytes.Buffer
+	if err := json.Indent(&out, body, "", "  "); err != nil {
+		return err
+	}
+	_, err = out.WriteTo(os.Stdout)
+	return err
+}
+
+// hmacTokenCommand prints a time-limited token that servers with the same HMAC secret accept
+func hmacTokenCommand(args []string) error {
+	fs := flag.NewFlagSet("hmac-token", flag.ExitOnError)
+	secret := fs.String("secret", os.Getenv("RAZPROXY_HMAC_SECRET"), "HMAC secret of the server (defaults to $RAZPROXY_HMAC_SECRET)")
+	user := fs.String("user", "", "User of the token")
+	ttl := fs.Duration("ttl", 24*time.Hour, "Validity of the token")
+	fs.Parse(args)
+
+	if len(*secret) == 0 || len(*user) == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	fmt.Println(razproxy.NewHMACToken([]byte(*secret), *user, *ttl))
+	return nil
+}
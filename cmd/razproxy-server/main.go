@@ -2,14 +2,24 @@ package main
 
 import (
 	"flag"
+	"fmt"
+	"io"
 	"log"
+	"net/http"
 	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/razzie/razproxy"
+	"golang.org/x/time/rate"
 )
 
 // command line args
 var (
+	ConfigFile  string
 	ServerAddr  string
 	CertFile    string
 	KeyFile     string
@@ -17,27 +27,434 @@ var (
 	Password    string
 	ExternalDNS string
 	LAN         bool
+	SmuxVersion int
+	KeepAlive   time.Duration
+	QUIC        bool
+	WSPath      string
+	ProxyFrom   string
+	Fallback    string
+	Secret      string
+	RequireALPN bool
+	Outbounds   string
+	Outbound    string
+	RulesFile   string
+	Reverse     string
+	RateLimit   float64
+	RateBurst   int
+	ReloadKick  bool
+	AdminAddr   string
+	AdminToken  string
+	SessionKey  string
+	JWKS        string
+	JWTIssuer   string
+	JWTAudience string
+	JWTClaim    string
+	HMACSecret  string
+	LDAPURL     string
+	LDAPBaseDN  string
+	LDAPBindDN  string
+	LDAPBindPW  string
+	LDAPFilter  string
+	LDAPTLS     bool
+	RADIUS      string
+	RADIUSKey   string
+	AuthTimeout time.Duration
+	NoLegacy    bool
+)
+
+// only available in the config file
+var (
+	Users            map[string]string
+	UserOutbounds    map[string]string
+	FileOutbounds    map[string]string
+	BandwidthClasses map[string]int
+	UserClasses      map[string]string
+	BearerTokens     map[string]string
+	LDAPGroups       []string
+	LDAPPolicies     []razproxy.GroupPolicy
+)
+
+// fileConfig is the format of the config file, with the same names as the command line args
+type fileConfig struct {
+	Addr             []string               `json:"addr"`
+	Cert             string                 `json:"cert"`
+	Key              string                 `json:"key"`
+	Users            map[string]string      `json:"users"`
+	DNS              string                 `json:"dns"`
+	LAN              bool                   `json:"lan"`
+	Smux             int                    `json:"smux"`
+	KeepAlive        razproxy.Duration      `json:"keepalive"`
+	QUIC             bool                   `json:"quic"`
+	WSPath           string                 `json:"ws-path"`
+	ProxyFrom        []string               `json:"proxy-from"`
+	Fallback         string                 `json:"fallback"`
+	Secret           string                 `json:"secret"`
+	RequireALPN      bool                   `json:"require-alpn"`
+	Outbounds        map[string]string      `json:"outbounds"`
+	Outbound         string                 `json:"outbound"`
+	UserOutbounds    map[string]string      `json:"user-outbounds"`
+	Rules            string                 `json:"rules"`
+	Reverse          []string               `json:"reverse"`
+	Rate             float64                `json:"rate"`
+	Burst            int                    `json:"burst"`
+	BandwidthClasses map[string]int         `json:"bandwidth-classes"` // bytes per second
+	UserClasses      map[string]string      `json:"user-classes"`
+	ReloadKick       bool                   `json:"reload-kick"`
+	AdminAddr        string                 `json:"admin-addr"`
+	AdminToken       string                 `json:"admin-token"`
+	SessionKey       string                 `json:"session-key"`
+	JWKS             string                 `json:"jwks"`
+	JWTIssuer        string                 `json:"jwt-issuer"`
+	JWTAudience      string                 `json:"jwt-audience"`
+	JWTClaim         string                 `json:"jwt-user-claim"`
+	HMACSecret       string                 `json:"hmac-secret"`
+	BearerTokens     map[string]string      `json:"bearer-tokens"` // token to user
+	LDAP             string                 `json:"ldap"`
+	LDAPBaseDN       string                 `json:"ldap-base-dn"`
+	LDAPBindDN       string                 `json:"ldap-bind-dn"`
+	LDAPBindPW       string                 `json:"ldap-bind-pw"`
+	LDAPFilter       string                 `json:"ldap-filter"`
+	LDAPStartTLS     bool                   `json:"ldap-starttls"`
+	LDAPGroups       []string               `json:"ldap-required-groups"`
+	LDAPPolicies     []razproxy.GroupPolicy `json:"ldap-group-policies"`
+	RADIUS           string                 `json:"radius"`
+	RADIUSSecret     string                 `json:"radius-secret"`
+	AuthTimeout      razproxy.Duration      `json:"auth-timeout"`
+	RejectLegacy     bool                   `json:"reject-legacy-clients"`
+}
+
+// args given on the command line, which are not overridden by the config file
+var givenArgs = make(map[string]bool)
+
+// the rules are watched for changes, so they are only loaded again if the path changes
+var (
+	rulesFile string
+	rules     *razproxy.Router
 )
 
 func init() {
-	flag.StringVar(&ServerAddr, "addr", ":9820", "Server address")
+	if subcommand() != nil {
+		return
+	}
+
+	flag.StringVar(&ConfigFile, "config", "", "JSON config file path (command line args override the file, SIGHUP reloads it)")
+	flag.StringVar(&ServerAddr, "addr", ":9820", "Server address (comma separated list for multiple listeners, may be prefixed by transport, e.g. unix:///run/razproxy.sock)")
 	flag.StringVar(&CertFile, "cert", "", "TLS cert file path")
 	flag.StringVar(&KeyFile, "key", "", "TLS key file path")
 	flag.StringVar(&User, "user", "", "Username for auth")
 	flag.StringVar(&Password, "pw", "", "Password for auth")
 	flag.StringVar(&ExternalDNS, "dns", "", "External DNS address")
 	flag.BoolVar(&LAN, "lan", false, "Enable requests towards LAN and localhost IP address range")
+	flag.IntVar(&SmuxVersion, "smux", 1, "smux protocol version (must match the clients)")
+	flag.DurationVar(&KeepAlive, "keepalive", 10*time.Second, "Keepalive interval")
+	flag.BoolVar(&QUIC, "quic", false, "Also accept QUIC connections on the same UDP port")
+	flag.StringVar(&WSPath, "ws-path", "", "Accept WebSocket tunnels on this HTTP path")
+	flag.StringVar(&ProxyFrom, "proxy-from", "", "Comma separated CIDRs of load balancers that send PROXY protocol headers")
+	flag.StringVar(&Fallback, "fallback", "", "Forward non-tunnel connections to this address (e.g. a local web server)")
+	flag.StringVar(&Secret, "secret", "", "Pre-shared secret clients have to send")
+	flag.BoolVar(&RequireALPN, "require-alpn", false, "Only accept tunnels from clients that negotiate the razproxy ALPN protocol")
+	flag.StringVar(&Outbounds, "outbounds", "", "Comma separated list of named outbounds (name=direct://?source=ip1&source=ip2&interface=eth1&fwmark=1, name=socks5://host:port, name=http://host:port or name=razproxy://user:pw@host:port)")
+	flag.StringVar(&Outbound, "outbound", "", "Name of the default outbound")
+	flag.StringVar(&RulesFile, "rules", "", "Outbound rules file path")
+	flag.StringVar(&Reverse, "reverse", "", "Comma separated list of addresses users may listen on for reverse tunnels ([user@][host:]port[-port])")
+	flag.Float64Var(&RateLimit, "rate", 1, "Number of new tunnels per minute allowed from an IP")
+	flag.IntVar(&RateBurst, "burst", 3, "Number of tunnels an IP may open at once")
+	flag.BoolVar(&ReloadKick, "reload-kick", false, "Close the sessions of users who are no longer valid after a reload")
+	flag.StringVar(&AdminAddr, "admin-addr", "", "Serve the admin API on this address (e.g. 127.0.0.1:9821)")
+	flag.StringVar(&AdminToken, "admin-token", "", "Bearer token of the admin API")
+	flag.StringVar(&JWKS, "jwks", "", "JWKS URL of an identity provider to accept its JWTs")
+	flag.StringVar(&JWTIssuer, "jwt-issuer", "", "Required issuer of JWTs")
+	flag.StringVar(&JWTAudience, "jwt-audience", "", "Required audience of JWTs")
+	flag.StringVar(&JWTClaim, "jwt-user-claim", "sub", "JWT claim that contains the user name")
+	flag.StringVar(&HMACSecret, "hmac-secret", "", "Accept tokens signed with this secret (see razproxy-server hmac-token)")
+	flag.StringVar(&LDAPURL, "ldap", "", "Authenticate users at this LDAP server (ldap://host:389 or ldaps://host:636)")
+	flag.StringVar(&LDAPBaseDN, "ldap-base-dn", "", "LDAP base DN of users")
+	flag.StringVar(&LDAPBindDN, "ldap-bind-dn", "", "LDAP service account that searches users (anonymous if empty)")
+	flag.StringVar(&LDAPBindPW, "ldap-bind-pw", "", "Password of the LDAP service account")
+	flag.StringVar(&LDAPFilter, "ldap-filter", "(uid=%s)", "LDAP search filter of users")
+	flag.BoolVar(&LDAPTLS, "ldap-starttls", false, "Use StartTLS on ldap:// connections")
+	flag.StringVar(&RADIUS, "radius", "", "Authenticate users at this RADIUS server with PAP (host:port)")
+	flag.StringVar(&RADIUSKey, "radius-secret", "", "Shared secret of the RADIUS server")
+	flag.DurationVar(&AuthTimeout, "auth-timeout", 10*time.Second, "Time the authenticators have to check the credentials of a client")
+	flag.BoolVar(&NoLegacy, "reject-legacy-clients", false, "Reject clients that are too old to speak the versioned control protocol")
+	flag.StringVar(&SessionKey, "session-key", "", "Secret key of session tokens, so clients can resume their sessions after a restart (random if empty)")
 	flag.Parse()
+
+	flag.Visit(func(f *flag.Flag) {
+		givenArgs[f.Name] = true
+	})
+	if len(ConfigFile) > 0 {
+		if err := loadConfig(ConfigFile); err != nil {
+			log.Fatal(err)
+		}
+	}
 }
 
-func main() {
-	logger := log.New(os.Stdout, "", log.LstdFlags)
+// loadConfig sets the args that are not given on the command line from the config file
+//
+// Args that are missing from the file are reset to their defaults, so removing
+// a setting from the file and reloading it has the expected effect.
+func loadConfig(file string) error {
+	var conf fileConfig
+	if err := razproxy.LoadConfig(file, &conf); err != nil {
+		return err
+	}
+
+	values := map[string]string{
+		"addr":           strings.Join(conf.Addr, ","),
+		"cert":           conf.Cert,
+		"key":            conf.Key,
+		"dns":            conf.DNS,
+		"ws-path":        conf.WSPath,
+		"proxy-from":     strings.Join(conf.ProxyFrom, ","),
+		"fallback":       conf.Fallback,
+		"secret":         conf.Secret,
+		"outbound":       conf.Outbound,
+		"rules":          conf.Rules,
+		"reverse":        strings.Join(conf.Reverse, ","),
+		"admin-addr":     conf.AdminAddr,
+		"admin-token":    conf.AdminToken,
+		"session-key":    conf.SessionKey,
+		"jwks":           conf.JWKS,
+		"jwt-issuer":     conf.JWTIssuer,
+		"jwt-audience":   conf.JWTAudience,
+		"jwt-user-claim": conf.JWTClaim,
+		"hmac-secret":    conf.HMACSecret,
+		"ldap":           conf.LDAP,
+		"ldap-base-dn":   conf.LDAPBaseDN,
+		"ldap-bind-dn":   conf.LDAPBindDN,
+		"ldap-bind-pw":   conf.LDAPBindPW,
+		"ldap-filter":    conf.LDAPFilter,
+		"radius":         conf.RADIUS,
+		"radius-secret":  conf.RADIUSSecret,
+	}
+	if conf.LAN {
+		values["lan"] = "true"
+	}
+	if conf.Smux != 0 {
+		values["smux"] = fmt.Sprint(conf.Smux)
+	}
+	if conf.KeepAlive != 0 {
+		values["keepalive"] = time.Duration(conf.KeepAlive).String()
+	}
+	if conf.QUIC {
+		values["quic"] = "true"
+	}
+	if conf.RequireALPN {
+		values["require-alpn"] = "true"
+	}
+	if conf.AuthTimeout != 0 {
+		values["auth-timeout"] = time.Duration(conf.AuthTimeout).String()
+	}
+	if conf.Rate != 0 {
+		values["rate"] = fmt.Sprint(conf.Rate)
+	}
+	if conf.Burst != 0 {
+		values["burst"] = fmt.Sprint(conf.Burst)
+	}
+	if conf.ReloadKick {
+		values["reload-kick"] = "true"
+	}
+	if conf.LDAPStartTLS {
+		values["ldap-starttls"] = "true"
+	}
+	if conf.RejectLegacy {
+		values["reject-legacy-clients"] = "true"
+	}
+
+	var err error
+	flag.VisitAll(func(f *flag.Flag) {
+		if givenArgs[f.Name] || f.Name == "config" || err != nil {
+			return
+		}
+		value, ok := values[f.Name]
+		if !ok || len(value) == 0 {
+			value = f.DefValue
+		}
+		if setErr := flag.Set(f.Name, value); setErr != nil {
+			err = fmt.Errorf("%s: %s: %w", file, f.Name, setErr)
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	Users = conf.Users
+	UserOutbounds = conf.UserOutbounds
+	FileOutbounds = conf.Outbounds
+	BandwidthClasses = conf.BandwidthClasses
+	UserClasses = conf.UserClasses
+	BearerTokens = conf.BearerTokens
+	LDAPGroups = conf.LDAPGroups
+	LDAPPolicies = conf.LDAPPolicies
+	return nil
+}
 
-	var auth razproxy.Authenticator
-	if len(User) > 0 {
-		auth = razproxy.BasicAuthenticator{User: Password}
+// settings returns the authenticator and a function that applies the settings
+// which can change on reload to the server
+func settings(logger *log.Logger) (razproxy.ContextAuthenticator, func(srv *razproxy.Server), error) {
+	var chain razproxy.ChainAuthenticator
+	if len(User) > 0 || len(Users) > 0 {
+		users := make(razproxy.BasicAuthenticator)
+		for user, password := range Users {
+			users[user] = password
+		}
+		if len(User) > 0 {
+			users[User] = Password
+		}
+		chain = append(chain, users)
+	}
+	chain = append(chain, remoteAuthenticators(logger)...)
+
+	var auth razproxy.ContextAuthenticator = &razproxy.NilAuthenticator{}
+	switch len(chain) {
+	case 0:
+	case 1:
+		auth = chain[0]
+	default:
+		auth = chain
 	}
 
+	tokenAuth := make(map[string]razproxy.TokenAuthenticator)
+	if len(BearerTokens) > 0 {
+		tokenAuth[razproxy.CredentialBearer] = razproxy.BearerAuthenticator(BearerTokens)
+	}
+	if len(JWKS) > 0 {
+		jwtAuth := razproxy.NewJWTAuthenticator(JWKS, JWTIssuer, JWTAudience)
+		jwtAuth.UserClaim = JWTClaim
+		tokenAuth[razproxy.CredentialJWT] = jwtAuth
+	}
+	if len(HMACSecret) > 0 {
+		tokenAuth[razproxy.CredentialHMAC] = &razproxy.HMACAuthenticator{Secret: []byte(HMACSecret)}
+	}
+	if _, ok := auth.(*razproxy.NilAuthenticator); ok && len(tokenAuth) > 0 {
+		auth = razproxy.BasicAuthenticator{} // only token credentials are accepted
+	}
+
+	newRules := rules
+	if RulesFile != rulesFile {
+		newRules = nil
+		if len(RulesFile) > 0 {
+			var err error
+			newRules, err = razproxy.LoadRouter(RulesFile, logger)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+		rulesFile, rules = RulesFile, newRules
+	}
+
+	var reverseRules []razproxy.ReverseRule
+	if len(Reverse) > 0 {
+		for _, r := range strings.Split(Reverse, ",") {
+			rule, err := razproxy.ParseReverseRule(strings.TrimSpace(r))
+			if err != nil {
+				return nil, nil, err
+			}
+			reverseRules = append(reverseRules, rule)
+		}
+	}
+
+	externalDNS, lan, outbound, userOutbounds := ExternalDNS, LAN, Outbound, UserOutbounds
+	limit, burst := rate.Limit(RateLimit/60), RateBurst
+	bandwidthClasses, userClasses := BandwidthClasses, UserClasses
+	authTimeout, noLegacy := AuthTimeout, NoLegacy
+	return auth, func(srv *razproxy.Server) {
+		srv.ExternalDNS = externalDNS
+		srv.LAN = lan
+		srv.Rules = newRules
+		srv.Outbound = outbound
+		srv.UserOutbounds = userOutbounds
+		srv.ReverseRules = reverseRules
+		srv.RateLimit = limit
+		srv.RateBurst = burst
+		srv.BandwidthClasses = bandwidthClasses
+		srv.UserClasses = userClasses
+		srv.TokenAuth = tokenAuth
+		srv.AuthTimeout = authTimeout
+		srv.RejectLegacyClients = noLegacy
+	}, nil
+}
+
+// remote authenticators are kept across reloads while their settings don't
+// change, so their connection pools and caches survive
+var remoteAuth = make(map[string]io.Closer)
+
+func remoteAuthenticators(logger *log.Logger) []razproxy.ContextAuthenticator {
+	var auths []razproxy.ContextAuthenticator
+	used := make(map[string]bool)
+	add := func(key string, newAuth func() io.Closer) {
+		auth, ok := remoteAuth[key]
+		if !ok {
+			auth = newAuth()
+			remoteAuth[key] = auth
+		}
+		used[key] = true
+		auths = append(auths, auth.(razproxy.ContextAuthenticator))
+	}
+
+	if len(LDAPURL) > 0 {
+		key := fmt.Sprint("ldap", LDAPURL, LDAPBaseDN, LDAPBindDN, LDAPBindPW, LDAPFilter, LDAPTLS, LDAPGroups, LDAPPolicies)
+		add(key, func() io.Closer {
+			ldap := razproxy.NewLDAPAuthenticator(LDAPURL, LDAPBaseDN)
+			ldap.BindDN = LDAPBindDN
+			ldap.BindPassword = LDAPBindPW
+			ldap.UserFilter = LDAPFilter
+			ldap.StartTLS = LDAPTLS
+			ldap.RequiredGroups = LDAPGroups
+			ldap.GroupPolicies = LDAPPolicies
+			ldap.Logger = logger
+			return ldap
+		})
+	}
+	if len(RADIUS) > 0 {
+		key := fmt.Sprint("radius", RADIUS, RADIUSKey)
+		add(key, func() io.Closer {
+			return razproxy.NewRADIUSAuthenticator(RADIUS, RADIUSKey)
+		})
+	}
+
+	for key, auth := range remoteAuth {
+		if !used[key] {
+			auth.Close()
+			delete(remoteAuth, key)
+		}
+	}
+	return auths
+}
+
+var reloadMtx sync.Mutex
+
+// reload applies the changes of the config file to the server
+func reload(srv *razproxy.Server, logger *log.Logger) error {
+	reloadMtx.Lock()
+	defer reloadMtx.Unlock()
+
+	if len(ConfigFile) == 0 {
+		return fmt.Errorf("no config file to reload")
+	}
+	if err := loadConfig(ConfigFile); err != nil {
+		return err
+	}
+	auth, update, err := settings(logger)
+	if err != nil {
+		return err
+	}
+	srv.Reload(auth, update, ReloadKick)
+	return nil
+}
+
+func main() {
+	if cmd := subcommand(); cmd != nil {
+		if err := cmd(os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	logger := log.New(os.Stdout, "", log.LstdFlags)
+
 	var certLoader razproxy.CertLoader
 	if len(CertFile) > 0 {
 		var err error
@@ -47,15 +464,84 @@ func main() {
 		}
 	}
 
+	auth, update, err := settings(logger)
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	srv, err := razproxy.NewServer(auth, certLoader, logger)
 	if err != nil {
 		log.Fatal(err)
 	}
+	update(srv)
 
-	srv.ExternalDNS = ExternalDNS
-	srv.LAN = LAN
+	srv.SessionKey = []byte(SessionKey)
+	srv.WebSocketPath = WSPath
+	srv.Fallback = Fallback
+	srv.Secret = Secret
+	srv.RequireALPN = RequireALPN
+	if len(ProxyFrom) > 0 {
+		srv.TrustedProxies = strings.Split(ProxyFrom, ",")
+	}
+	srv.Tunnel = &razproxy.TunnelConfig{
+		Version:           SmuxVersion,
+		KeepAliveInterval: KeepAlive,
+		KeepAliveTimeout:  3 * KeepAlive,
+	}
 
-	if err := srv.ListenAndServe(ServerAddr); err != nil {
-		log.Fatal(err)
+	outbounds := make(map[string]string)
+	for name, rawurl := range FileOutbounds {
+		outbounds[name] = rawurl
+	}
+	if len(Outbounds) > 0 {
+		for _, outbound := range strings.Split(Outbounds, ",") {
+			name, rawurl, ok := strings.Cut(strings.TrimSpace(outbound), "=")
+			if !ok {
+				log.Fatal("invalid outbound: ", outbound)
+			}
+			outbounds[name] = rawurl
+		}
+	}
+	if len(outbounds) > 0 {
+		srv.Outbounds = make(map[string]razproxy.Outbound)
+		for name, rawurl := range outbounds {
+			o, err := razproxy.NewOutbound(rawurl)
+			if err != nil {
+				log.Fatal(err)
+			}
+			srv.Outbounds[name] = o
+		}
+	}
+
+	for _, addr := range strings.Split(ServerAddr, ",") {
+		addr = strings.TrimSpace(addr)
+		if err := srv.AddListener(addr); err != nil {
+			log.Fatal(err)
+		}
+		if QUIC && !strings.Contains(addr, "://") {
+			if err := srv.AddListener("quic://" + addr); err != nil {
+				log.Fatal(err)
+			}
+		}
+	}
+
+	if len(AdminAddr) > 0 {
+		if len(AdminToken) == 0 {
+			log.Fatal("admin API needs a token")
+		}
+		admin := srv.AdminHandler(AdminToken, func() error {
+			return reload(srv, logger)
+		})
+		go func() {
+			log.Fatal(http.ListenAndServe(AdminAddr, admin))
+		}()
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		if err := reload(srv, logger); err != nil {
+			logger.Println("reload error:", err)
+		}
 	}
 }
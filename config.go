@@ -0,0 +1,95 @@
+package razproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"time"
+)
+
+var (
+	envRegexp    = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+	quotedRegexp = regexp.MustCompile(`"[^"]*"`)
+)
+
+// LoadConfig reads a JSON config file into v
+//
+// References to environment variables in the form of ${VAR} are replaced by
+// their values, so secrets don't have to be stored in the file. Unknown fields
+// are rejected, and errors contain the line number of the problem.
+func LoadConfig(file string, v interface{}) error {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	data, err = expandEnv(data)
+	if err != nil {
+		return fmt.Errorf("%s:%w", file, err)
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		offset := dec.InputOffset()
+		var syntaxErr *json.SyntaxError
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &syntaxErr) {
+			offset = syntaxErr.Offset
+		} else if errors.As(err, &typeErr) {
+			offset = typeErr.Offset
+		} else if quoted := quotedRegexp.Find([]byte(err.Error())); quoted != nil {
+			// e.g. unknown fields or invalid values are looked up by their name
+			if i := bytes.Index(data, quoted); i >= 0 {
+				offset = int64(i)
+			}
+		}
+		return fmt.Errorf("%s:%d: %w", file, lineOf(data, offset), err)
+	}
+	return nil
+}
+
+// expandEnv replaces ${VAR} references with the JSON escaped values of environment variables
+func expandEnv(data []byte) ([]byte, error) {
+	var err error
+	data = envRegexp.ReplaceAllFunc(data, func(ref []byte) []byte {
+		name := string(envRegexp.FindSubmatch(ref)[1])
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			if err == nil {
+				offset := bytes.Index(data, ref)
+				err = fmt.Errorf("%d: environment variable %s is not set", lineOf(data, int64(offset)), name)
+			}
+			return ref
+		}
+		quoted, _ := json.Marshal(value)
+		return quoted[1 : len(quoted)-1]
+	})
+	return data, err
+}
+
+func lineOf(data []byte, offset int64) int {
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	return bytes.Count(data[:offset], []byte("\n")) + 1
+}
+
+// Duration is a time.Duration that is read from config files in the form of "10s"
+type Duration time.Duration
+
+// UnmarshalJSON implements json.Unmarshaler
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("invalid duration %s (expected a string like \"10s\")", b)
+	}
+	dur, err := time.ParseDuration(s)
+	if err != nil {
+		return fmt.Errorf("invalid duration %q", s)
+	}
+	*d = Duration(dur)
+	return nil
+}
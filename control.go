@@ -0,0 +1,430 @@
+package razproxy
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+)
+
+// The control protocol runs on the first stream of each session. The client
+// starts it with controlMagic, then both sides exchange hello messages to agree
+// on a version and a set of features. After that the client sends requests and
+// the server sends responses, matched by their IDs. All messages are JSON
+// objects prefixed by their length as a 32-bit big-endian integer.
+//
+// The first byte of controlMagic can't start a gob stream, which lets servers
+// serve the net/rpc protocol of older clients on the same stream.
+const controlMagic = "\xa5RZCP"
+
+// Versions of the control protocol supported by this implementation
+const (
+	ControlMinVersion = 1
+	ControlMaxVersion = 1
+)
+
+// Features of the control protocol
+//
+// The features are negotiated in the hello messages, and only those known by
+// both sides are used. Unknown features are ignored, so new ones can be added
+// without a new protocol version.
+const (
+	FeatureReverse          = "reverse"           // reverse method
+	FeatureSessionToken     = "session-token"     // auth returns session tokens and accepts them to resume sessions
+	FeatureTokenCredentials = "token-credentials" // auth accepts the credential types of TokenAuth
+)
+
+var controlFeatures = []string{FeatureReverse, FeatureSessionToken, FeatureTokenCredentials}
+
+const controlMaxMessageSize = 1 << 20
+
+// ControlErrorCode tells the reason of a failed control request
+type ControlErrorCode string
+
+// Error codes of the control protocol
+const (
+	ErrCodeUnsupportedVersion ControlErrorCode = "unsupported_version"
+	ErrCodeUnsupportedFeature ControlErrorCode = "unsupported_feature"
+	ErrCodeUnknownMethod      ControlErrorCode = "unknown_method"
+	ErrCodeBadRequest         ControlErrorCode = "bad_request"
+	ErrCodeUnauthenticated    ControlErrorCode = "unauthenticated"
+	ErrCodeAuthFailed         ControlErrorCode = "auth_failed"      // the credentials are rejected
+	ErrCodeAuthUnavailable    ControlErrorCode = "auth_unavailable" // the credentials can't be checked now
+	ErrCodeForbidden          ControlErrorCode = "forbidden"
+	ErrCodeInternal           ControlErrorCode = "internal"
+)
+
+// ControlError is the error of a control request
+type ControlError struct {
+	Code    ControlErrorCode `json:"code"`
+	Message string           `json:"message,omitempty"`
+}
+
+func (e *ControlError) Error() string {
+	if len(e.Message) == 0 {
+		return string(e.Code)
+	}
+	return string(e.Code) + ": " + e.Message
+}
+
+type controlHello struct {
+	MinVersion int      `json:"min_version"`
+	MaxVersion int      `json:"max_version"`
+	Features   []string `json:"features"`
+}
+
+type controlHelloReply struct {
+	Version  int           `json:"version,omitempty"`
+	Features []string      `json:"features,omitempty"`
+	Error    *ControlError `json:"error,omitempty"`
+}
+
+type controlMessage struct {
+	ID     uint64          `json:"id"`
+	Method string          `json:"method,omitempty"`
+	Params json.RawMessage `json:"params,omitempty"`
+	Result json.RawMessage `json:"result,omitempty"`
+	Error  *ControlError   `json:"error,omitempty"`
+}
+
+func writeControlMessage(w io.Writer, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, 4+len(data))
+	binary.BigEndian.PutUint32(buf, uint32(len(data)))
+	copy(buf[4:], data)
+	_, err = w.Write(buf)
+	return err
+}
+
+func readControlMessage(r io.Reader, v interface{}) error {
+	var header [4]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return err
+	}
+	size := binary.BigEndian.Uint32(header[:])
+	if size > controlMaxMessageSize {
+		return fmt.Errorf("control message too large: %d bytes", size)
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// negotiate returns the highest common version and the common features
+func negotiate(hello *controlHello) (int, []string, error) {
+	version := ControlMaxVersion
+	if hello.MaxVersion < version {
+		version = hello.MaxVersion
+	}
+	if version < ControlMinVersion || version < hello.MinVersion {
+		return 0, nil, &ControlError{
+			Code:    ErrCodeUnsupportedVersion,
+			Message: fmt.Sprintf("server supports versions %d-%d", ControlMinVersion, ControlMaxVersion),
+		}
+	}
+	var features []string
+	for _, f := range hello.Features {
+		if hasFeature(controlFeatures, f) {
+			features = append(features, f)
+		}
+	}
+	return version, features, nil
+}
+
+func hasFeature(features []string, feature string) bool {
+	for _, f := range features {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
+
+// controlMethod handles a control request of an authenticated or unauthenticated session
+type controlMethod struct {
+	feature string // required feature, if any
+	handle  func(s *serverSession, c *controlServer, params json.RawMessage) (interface{}, error)
+}
+
+var controlMethods = map[string]controlMethod{
+	"auth":    {handle: controlAuth},
+	"ping":    {handle: controlPing},
+	"reverse": {feature: FeatureReverse, handle: controlReverse},
+}
+
+type controlServer struct {
+	conn     net.Conn
+	writeMtx sync.Mutex
+	features []string
+}
+
+// serveControl serves the control protocol, or the net/rpc protocol if the client is older
+func (s *serverSession) serveControl(conn net.Conn) {
+	bconn := newBufferedConn(conn)
+	magic, err := bconn.Peek(len(controlMagic))
+	if err != nil {
+		return
+	}
+	if string(magic) != controlMagic {
+		s.serveLegacyControl(bconn)
+		return
+	}
+	bconn.r.Discard(len(controlMagic))
+
+	var hello controlHello
+	if err := readControlMessage(bconn, &hello); err != nil {
+		s.log("control error: ", err)
+		return
+	}
+	version, features, err := negotiate(&hello)
+	if err != nil {
+		s.log("control error: ", err)
+		writeControlMessage(conn, &controlHelloReply{Error: err.(*ControlError)})
+		return
+	}
+	if err := writeControlMessage(conn, &controlHelloReply{Version: version, Features: features}); err != nil {
+		return
+	}
+
+	s.log("control protocol v", version, " with features ", features)
+	c := &controlServer{
+		conn:     conn,
+		features: features,
+	}
+	for {
+		var req controlMessage
+		if err := readControlMessage(bconn, &req); err != nil {
+			if err != io.EOF {
+				s.log("control error: ", err)
+			}
+			return
+		}
+		// requests are handled one at a time until the client is authenticated,
+		// so unauthenticated clients can't start any number of auth checks
+		if _, _, authenticated := s.identity(); !authenticated {
+			c.handle(s, &req)
+			continue
+		}
+		go c.handle(s, &req)
+	}
+}
+
+func (c *controlServer) handle(s *serverSession, req *controlMessage) {
+	res := &controlMessage{ID: req.ID}
+	result, err := c.call(s, req)
+	if err == nil {
+		res.Result, err = json.Marshal(result)
+	}
+	if err != nil {
+		var ce *ControlError
+		if !errors.As(err, &ce) {
+			ce = &ControlError{Code: ErrCodeInternal, Message: err.Error()}
+		}
+		res.Error = ce
+	}
+
+	c.writeMtx.Lock()
+	defer c.writeMtx.Unlock()
+	writeControlMessage(c.conn, res)
+}
+
+func (c *controlServer) call(s *serverSession, req *controlMessage) (interface{}, error) {
+	method, ok := controlMethods[req.Method]
+	if !ok {
+		return nil, &ControlError{Code: ErrCodeUnknownMethod, Message: req.Method}
+	}
+	if len(method.feature) > 0 && !hasFeature(c.features, method.feature) {
+		return nil, &ControlError{Code: ErrCodeUnsupportedFeature, Message: method.feature}
+	}
+	return method.handle(s, c, req.Params)
+}
+
+func decodeParams(params json.RawMessage, v interface{}) error {
+	if err := json.Unmarshal(params, v); err != nil {
+		return &ControlError{Code: ErrCodeBadRequest, Message: err.Error()}
+	}
+	return nil
+}
+
+func controlAuth(s *serverSession, c *controlServer, params json.RawMessage) (interface{}, error) {
+	var req AuthRequest
+	if err := decodeParams(params, &req); err != nil {
+		return nil, err
+	}
+	if !hasFeature(c.features, FeatureSessionToken) {
+		req.Token = ""
+	}
+	if len(req.CredentialType) > 0 && !hasFeature(c.features, FeatureTokenCredentials) {
+		return nil, &ControlError{Code: ErrCodeUnsupportedFeature, Message: FeatureTokenCredentials}
+	}
+
+	id, err := s.auth(&req)
+	if err != nil {
+		reason, retry := authFailure(err)
+		if retry {
+			return nil, &ControlError{Code: ErrCodeAuthUnavailable, Message: reason}
+		}
+		return nil, &ControlError{Code: ErrCodeAuthFailed, Message: reason}
+	}
+	user, _, _ := s.identity()
+	res := &AuthResult{OK: true, ID: id, User: user}
+	if hasFeature(c.features, FeatureSessionToken) {
+		res.Token = s.srv.issueToken(id, user)
+	}
+	return res, nil
+}
+
+func controlPing(s *serverSession, c *controlServer, params json.RawMessage) (interface{}, error) {
+	var req PingRequest
+	if err := decodeParams(params, &req); err != nil {
+		return nil, err
+	}
+	return &PingResult{Seq: req.Seq}, nil
+}
+
+func controlReverse(s *serverSession, c *controlServer, params json.RawMessage) (interface{}, error) {
+	var req ReverseRequest
+	if err := decodeParams(params, &req); err != nil {
+		return nil, err
+	}
+	res := new(ReverseResult)
+	var err error
+	res.ID, res.Addr, err = s.reverse(req.Addr)
+	return res, err
+}
+
+// controlClient is the client side of a control stream
+type controlClient interface {
+	call(method string, params, result interface{}) error
+	has(feature string) bool
+	Close() error
+}
+
+// errLegacyServer means that the server closed the control stream right after
+// the magic without sending anything, as servers do that only speak the net/rpc
+// protocol
+var errLegacyServer = errors.New("server does not support the control protocol")
+
+type controlConn struct {
+	conn       net.Conn
+	writeMtx   sync.Mutex
+	pendingMtx sync.Mutex
+	pending    map[uint64]chan *controlMessage
+	nextID     uint64
+	err        error
+	features   []string
+}
+
+// newControlClient starts the control protocol on conn
+func newControlClient(conn net.Conn) (*controlConn, error) {
+	hello := &controlHello{
+		MinVersion: ControlMinVersion,
+		MaxVersion: ControlMaxVersion,
+		Features:   controlFeatures,
+	}
+	if _, err := conn.Write([]byte(controlMagic)); err != nil {
+		return nil, err
+	}
+	if err := writeControlMessage(conn, hello); err != nil {
+		return nil, err
+	}
+	var reply controlHelloReply
+	if err := readControlMessage(conn, &reply); err != nil {
+		if err == io.EOF { // a truncated reply is not from a legacy server
+			return nil, errLegacyServer
+		}
+		return nil, err
+	}
+	if reply.Error != nil {
+		return nil, reply.Error
+	}
+	if reply.Version < ControlMinVersion || reply.Version > ControlMaxVersion {
+		return nil, &ControlError{Code: ErrCodeUnsupportedVersion, Message: fmt.Sprint("server picked version ", reply.Version)}
+	}
+
+	c := &controlConn{
+		conn:     conn,
+		pending:  make(map[uint64]chan *controlMessage),
+		features: reply.Features,
+	}
+	go c.readResponses()
+	return c, nil
+}
+
+func (c *controlConn) readResponses() {
+	var err error
+	for {
+		res := new(controlMessage)
+		if err = readControlMessage(c.conn, res); err != nil {
+			break
+		}
+		c.pendingMtx.Lock()
+		ch, ok := c.pending[res.ID]
+		delete(c.pending, res.ID)
+		c.pendingMtx.Unlock()
+		if ok {
+			ch <- res
+		}
+	}
+
+	c.pendingMtx.Lock()
+	defer c.pendingMtx.Unlock()
+	c.err = err
+	for id, ch := range c.pending {
+		close(ch)
+		delete(c.pending, id)
+	}
+}
+
+func (c *controlConn) call(method string, params, result interface{}) error {
+	data, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+
+	ch := make(chan *controlMessage, 1)
+	c.pendingMtx.Lock()
+	if c.err != nil {
+		c.pendingMtx.Unlock()
+		return c.err
+	}
+	c.nextID++
+	id := c.nextID
+	c.pending[id] = ch
+	c.pendingMtx.Unlock()
+
+	c.writeMtx.Lock()
+	err = writeControlMessage(c.conn, &controlMessage{ID: id, Method: method, Params: data})
+	c.writeMtx.Unlock()
+	if err != nil {
+		c.pendingMtx.Lock()
+		delete(c.pending, id)
+		c.pendingMtx.Unlock()
+		return err
+	}
+
+	res, ok := <-ch
+	if !ok {
+		return fmt.Errorf("control stream closed")
+	}
+	if res.Error != nil {
+		return res.Error
+	}
+	return json.Unmarshal(res.Result, result)
+}
+
+func (c *controlConn) has(feature string) bool {
+	return hasFeature(c.features, feature)
+}
+
+func (c *controlConn) Close() error {
+	return c.conn.Close()
+}
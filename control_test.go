@@ -0,0 +1,380 @@
+package razproxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/rpc"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+const pingTestTimeout = 5 * time.Second
+
+// testDialer connects upstreams to an in-process server over net.Pipe
+type testDialer func(t tunnel)
+
+func (serve testDialer) Dial(address string) (io.ReadWriteCloser, error) {
+	client, server := net.Pipe()
+	t, err := newSmuxTunnel(server, nil, true)
+	if err != nil {
+		return nil, err
+	}
+	go serve(t)
+	return client, nil
+}
+
+func newTestServer(t *testing.T) *Server {
+	srv, err := NewServer(BasicAuthenticator{"alice": "alice-pw"}, nil, log.New(io.Discard, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return srv
+}
+
+func newTestUpstream(dialer Dialer) *upstream {
+	c := &Client{
+		conf:    &ClientConfig{},
+		Logger:  log.New(io.Discard, "", 0),
+		stateCh: make(chan struct{}),
+	}
+	return newUpstream(c, Upstream{
+		Addr:      "test",
+		Transport: TransportPipe,
+		User:      "alice",
+		Password:  "alice-pw",
+		Dialer:    dialer,
+	})
+}
+
+// serveTest runs a session of srv, as a server of this version does
+func serveTest(srv *Server) testDialer {
+	return func(t tunnel) {
+		srv.newSession(t).run()
+	}
+}
+
+// BaselineAuthRequest and BaselineAuthResult are the messages of the first
+// server versions, whose net/rpc service only had the Auth method (exported,
+// because net/rpc only registers methods with exported argument types)
+type BaselineAuthRequest struct {
+	User     string
+	Password string
+}
+
+type BaselineAuthResult struct {
+	OK bool
+	ID string
+}
+
+type baselineRPC struct{}
+
+func (rpc *baselineRPC) Auth(req *BaselineAuthRequest, result *BaselineAuthResult) error {
+	result.ID, result.OK = uniqueID(), req.User == "alice" && req.Password == "alice-pw"
+	return nil
+}
+
+// serveLegacy serves the net/rpc protocol of the first server versions on the
+// first stream, and keeps the session open after the stream is closed as they do
+func serveLegacy(t tunnel) {
+	defer t.Close()
+	rpcConn, err := t.AcceptStream()
+	if err != nil {
+		return
+	}
+	rpcServ := rpc.NewServer()
+	rpcServ.RegisterName("RPC", new(baselineRPC))
+	go func() {
+		defer rpcConn.Close()
+		rpcServ.ServeConn(rpcConn)
+	}()
+	for {
+		stream, err := t.AcceptStream()
+		if err != nil {
+			return
+		}
+		stream.Close()
+	}
+}
+
+// openTestControl returns the control stream of a new session of srv
+func openTestControl(t *testing.T, srv *Server) net.Conn {
+	conn, err := serveTest(srv).Dial("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tun, err := newSmuxTunnel(conn, nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { tun.Close() })
+	stream, err := tun.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return stream
+}
+
+// helloTest starts the control protocol with a custom hello
+func helloTest(t *testing.T, conn net.Conn, hello *controlHello) *controlHelloReply {
+	if _, err := conn.Write([]byte(controlMagic)); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeControlMessage(conn, hello); err != nil {
+		t.Fatal(err)
+	}
+	reply := new(controlHelloReply)
+	if err := readControlMessage(conn, reply); err != nil {
+		t.Fatal(err)
+	}
+	return reply
+}
+
+func callTest(t *testing.T, conn net.Conn, method string, params string) *controlMessage {
+	if err := writeControlMessage(conn, &controlMessage{ID: 1, Method: method, Params: json.RawMessage(params)}); err != nil {
+		t.Fatal(err)
+	}
+	res := new(controlMessage)
+	if err := readControlMessage(conn, res); err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+func TestControlNewServer(t *testing.T) {
+	u := newTestUpstream(serveTest(newTestServer(t)))
+	session, err := u.newSession("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+	if _, ok := session.control.(*controlConn); !ok {
+		t.Fatalf("expected the control protocol, got %T", session.control)
+	}
+	for _, f := range controlFeatures {
+		if !session.control.has(f) {
+			t.Errorf("feature %s was not negotiated", f)
+		}
+	}
+	if len(u.getToken()) == 0 {
+		t.Error("no session token")
+	}
+	if _, err := session.ping(pingTestTimeout); err != nil {
+		t.Fatal(err)
+	}
+
+	u.Password = "wrong"
+	var authErr *AuthError
+	if _, err := u.newSession(""); !errors.As(err, &authErr) || authErr.Retry {
+		t.Fatalf("expected auth error, got %v", err)
+	}
+}
+
+func TestControlLegacyServer(t *testing.T) {
+	u := newTestUpstream(testDialer(serveLegacy))
+	if err := u.connect(); err != nil {
+		t.Fatal(err)
+	}
+	session := u.getSessions()[0]
+	if !session.isLegacy() {
+		t.Fatalf("expected the legacy protocol, got %T", session.control)
+	}
+	for _, f := range controlFeatures {
+		if session.control.has(f) {
+			t.Errorf("legacy server has feature %s", f)
+		}
+	}
+	joined, err := u.newSession(session.id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer joined.Close()
+	if !joined.isLegacy() {
+		t.Fatalf("expected the legacy protocol for joined sessions, got %T", joined.control)
+	}
+
+	// the health check doesn't drop sessions of servers without the Ping method
+	u.checkSessions()
+	if !u.isAvailable() || u.getSessions()[0] != session {
+		t.Fatal("health check dropped the legacy session")
+	}
+
+	u.Password = "wrong"
+	var authErr *AuthError
+	if _, err := u.newSession(""); !errors.As(err, &authErr) {
+		t.Fatalf("expected auth error, got %v", err)
+	}
+	u.Password = "alice-pw"
+
+	// the new protocol is tried again after the server is upgraded
+	session.Close()
+	u.Dialer = serveTest(newTestServer(t))
+	if err := u.connect(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := u.getSessions()[0].control.(*controlConn); !ok {
+		t.Fatalf("expected the control protocol after reconnect, got %T", u.getSessions()[0].control)
+	}
+}
+
+// slowAuthenticator rejects everyone after a delay and records the most checks at once
+type slowAuthenticator struct {
+	mtx       sync.Mutex
+	active    int
+	maxActive int
+}
+
+func (auth *slowAuthenticator) Authenticate(ctx context.Context, req AuthRequest) (Identity, error) {
+	auth.mtx.Lock()
+	auth.active++
+	auth.maxActive = max(auth.maxActive, auth.active)
+	auth.mtx.Unlock()
+	time.Sleep(20 * time.Millisecond)
+	auth.mtx.Lock()
+	auth.active--
+	auth.mtx.Unlock()
+	return Identity{}, ErrInvalidCredentials
+}
+
+func TestControlSequentialAuth(t *testing.T) {
+	auth := new(slowAuthenticator)
+	srv, err := NewServer(auth, nil, log.New(io.Discard, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := openTestControl(t, srv)
+	helloTest(t, conn, &controlHello{MinVersion: ControlMinVersion, MaxVersion: ControlMaxVersion})
+
+	const n = 4
+	for i := 1; i <= n; i++ {
+		req := &controlMessage{ID: uint64(i), Method: "auth", Params: json.RawMessage(`{"user":"alice","password":"x"}`)}
+		if err := writeControlMessage(conn, req); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < n; i++ {
+		if err := readControlMessage(conn, new(controlMessage)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if auth.maxActive != 1 {
+		t.Fatalf("unauthenticated client had %d auth checks at once", auth.maxActive)
+	}
+}
+
+func TestControlTruncatedHello(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	go io.Copy(io.Discard, server)
+	go func() {
+		server.Write([]byte{0, 0, 1})
+		server.Close()
+	}()
+	// only a stream closed without a reply means a legacy server
+	if _, err := newControlClient(client); err == nil || err == errLegacyServer {
+		t.Fatalf("expected a non-legacy error, got %v", err)
+	}
+}
+
+func TestControlLegacyClient(t *testing.T) {
+	tests := []struct {
+		name   string
+		reject bool
+	}{
+		{name: "served"},
+		{name: "rejected", reject: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := newTestServer(t)
+			srv.RejectLegacyClients = tt.reject
+			c := legacyControl{rpc.NewClient(openTestControl(t, srv))}
+			defer c.Close()
+
+			res := new(AuthResult)
+			if err := c.call("auth", &AuthRequest{User: "alice", Password: "alice-pw"}, res); err != nil {
+				t.Fatal(err)
+			}
+			if res.OK == tt.reject {
+				t.Fatalf("unexpected auth result: %+v", res)
+			}
+			if tt.reject {
+				return
+			}
+			if res.User != "alice" || len(res.Token) == 0 {
+				t.Fatalf("unexpected auth result: %+v", res)
+			}
+			ping := new(PingResult)
+			if err := c.call("ping", &PingRequest{Seq: 7}, ping); err != nil || ping.Seq != 7 {
+				t.Fatalf("unexpected ping result: %+v, %v", ping, err)
+			}
+		})
+	}
+}
+
+func TestControlNegotiation(t *testing.T) {
+	conn := openTestControl(t, newTestServer(t))
+	reply := helloTest(t, conn, &controlHello{
+		MinVersion: ControlMinVersion,
+		MaxVersion: ControlMaxVersion + 1,
+		Features:   []string{FeatureSessionToken, "future-feature"},
+	})
+	if reply.Error != nil || reply.Version != ControlMaxVersion {
+		t.Fatalf("unexpected hello reply: %+v", reply)
+	}
+	if !reflect.DeepEqual(reply.Features, []string{FeatureSessionToken}) {
+		t.Fatalf("unknown features were not ignored: %v", reply.Features)
+	}
+
+	tests := []struct {
+		name   string
+		method string
+		params string
+		code   ControlErrorCode
+	}{
+		{name: "unknown method", method: "future-method", params: "{}", code: ErrCodeUnknownMethod},
+		{name: "feature not negotiated", method: "reverse", params: `{"addr":":0"}`, code: ErrCodeUnsupportedFeature},
+		{name: "credentials not negotiated", method: "auth", params: `{"credential_type":"hmac","credential":"x"}`, code: ErrCodeUnsupportedFeature},
+		{name: "bad request", method: "ping", params: `"x"`, code: ErrCodeBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := callTest(t, conn, tt.method, tt.params)
+			if res.Error == nil || res.Error.Code != tt.code {
+				t.Fatalf("expected %s, got %+v", tt.code, res.Error)
+			}
+		})
+	}
+}
+
+func TestControlVersionMismatch(t *testing.T) {
+	conn := openTestControl(t, newTestServer(t))
+	reply := helloTest(t, conn, &controlHello{
+		MinVersion: ControlMaxVersion + 1,
+		MaxVersion: ControlMaxVersion + 2,
+	})
+	if reply.Error == nil || reply.Error.Code != ErrCodeUnsupportedVersion {
+		t.Fatalf("expected %s, got %+v", ErrCodeUnsupportedVersion, reply)
+	}
+
+	// clients reject versions they don't support, too
+	client, server := net.Pipe()
+	defer client.Close()
+	go func() {
+		defer server.Close()
+		var hello controlHello
+		server.Read(make([]byte, len(controlMagic)))
+		readControlMessage(server, &hello)
+		writeControlMessage(server, &controlHelloReply{Version: ControlMaxVersion + 1})
+	}()
+	_, err := newControlClient(client)
+	var controlErr *ControlError
+	if !errors.As(err, &controlErr) || controlErr.Code != ErrCodeUnsupportedVersion {
+		t.Fatalf("expected %s, got %v", ErrCodeUnsupportedVersion, err)
+	}
+}
@@ -0,0 +1,113 @@
+package razproxy
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// fakeDNS answers A queries with IPs from a private range and remembers the
+// names, so connections to these IPs can be proxied by domain name
+type fakeDNS struct {
+	mtx    sync.Mutex
+	first  uint32
+	size   uint32
+	next   uint32
+	skip   map[uint32]bool
+	byName map[string]uint32
+	byIP   map[uint32]string
+}
+
+func newFakeDNS(cidr string, skip ...net.IP) (*fakeDNS, error) {
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, err
+	}
+	ip := network.IP.To4()
+	ones, bits := network.Mask.Size()
+	if ip == nil || bits != 32 || ones > 24 {
+		return nil, fmt.Errorf("fake IP range must be an IPv4 network of at least /24: %s", cidr)
+	}
+
+	f := &fakeDNS{
+		first:  binary.BigEndian.Uint32(ip),
+		size:   1 << uint(bits-ones),
+		next:   1, // skip the network address
+		skip:   make(map[uint32]bool),
+		byName: make(map[string]uint32),
+		byIP:   make(map[uint32]string),
+	}
+	for _, ip := range skip {
+		if ip4 := ip.To4(); ip4 != nil {
+			f.skip[binary.BigEndian.Uint32(ip4)] = true
+		}
+	}
+	return f, nil
+}
+
+// lookup returns the name a fake IP was handed out for
+func (f *fakeDNS) lookup(ip net.IP) (string, bool) {
+	ip4 := ip.To4()
+	if ip4 == nil {
+		return "", false
+	}
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	name, ok := f.byIP[binary.BigEndian.Uint32(ip4)]
+	return name, ok
+}
+
+// allocate returns the fake IP of a name, reusing the oldest IPs once the range is exhausted
+func (f *fakeDNS) allocate(name string) net.IP {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	addr, ok := f.byName[name]
+	if !ok {
+		for {
+			addr = f.first + f.next
+			f.next++
+			if f.next >= f.size-1 { // skip the broadcast address
+				f.next = 1
+			}
+			if !f.skip[addr] {
+				break
+			}
+		}
+		if old, ok := f.byIP[addr]; ok {
+			delete(f.byName, old)
+		}
+		f.byName[name] = addr
+		f.byIP[addr] = name
+	}
+
+	ip := make(net.IP, 4)
+	binary.BigEndian.PutUint32(ip, addr)
+	return ip
+}
+
+// handle answers a DNS query message
+func (f *fakeDNS) handle(query []byte) ([]byte, error) {
+	req := new(dns.Msg)
+	if err := req.Unpack(query); err != nil {
+		return nil, err
+	}
+
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+	for _, q := range req.Question {
+		if q.Qclass != dns.ClassINET || q.Qtype != dns.TypeA {
+			continue // other types get an empty answer, so clients fall back to A records
+		}
+		name := strings.TrimSuffix(q.Name, ".")
+		resp.Answer = append(resp.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+			A:   f.allocate(name),
+		})
+	}
+	return resp.Pack()
+}
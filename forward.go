@@ -0,0 +1,89 @@
+package razproxy
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// LocalForward tunnels a local port to a fixed destination through the server
+//
+// Only TCP is supported, because sessions don't relay UDP.
+type LocalForward struct {
+	Local  string // local address to listen on, e.g. localhost:5432
+	Remote string // destination reachable from the server, e.g. db.internal:5432
+}
+
+// ParseLocalForward parses a forward in the form of [bind_address:]port:host:hostport
+//
+// IPv6 addresses have to be enclosed in square brackets.
+func ParseLocalForward(s string) (LocalForward, error) {
+	fields := splitForward(s)
+	if len(fields) == 3 {
+		fields = append([]string{"localhost"}, fields...)
+	}
+	if len(fields) != 4 {
+		return LocalForward{}, fmt.Errorf("invalid forward: %s", s)
+	}
+	for _, field := range fields {
+		if len(field) == 0 {
+			return LocalForward{}, fmt.Errorf("invalid forward: %s", s)
+		}
+	}
+	return LocalForward{
+		Local:  net.JoinHostPort(fields[0], fields[1]),
+		Remote: net.JoinHostPort(fields[2], fields[3]),
+	}, nil
+}
+
+// splitForward splits s at the colons outside of square brackets
+func splitForward(s string) []string {
+	var fields []string
+	var field strings.Builder
+	inBrackets := false
+	for _, r := range s {
+		switch {
+		case r == '[':
+			inBrackets = true
+		case r == ']':
+			inBrackets = false
+		case r == ':' && !inBrackets:
+			fields = append(fields, field.String())
+			field.Reset()
+		default:
+			field.WriteRune(r)
+		}
+	}
+	return append(fields, field.String())
+}
+
+// ListenAndForward opens a local port that tunnels every connection to the
+// forward's remote destination through the server
+func (c *Client) ListenAndForward(f LocalForward) error {
+	dest, err := parseAddrSpec(f.Remote)
+	if err != nil {
+		return err
+	}
+	l, err := net.Listen("tcp", f.Local)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			defer conn.Close()
+			remote, err := c.dial(dest)
+			if err != nil {
+				c.Logger.Println("forward error:", f.Remote+":", err)
+				return
+			}
+			defer remote.Close()
+			relay(conn, remote)
+		}()
+	}
+}
@@ -1,16 +1,34 @@
 module github.com/razzie/razproxy
 
-go 1.12
+go 1.23
 
 require (
 	github.com/armon/go-socks5 v0.0.0-20160902184237-e75332964ef5
 	github.com/fsnotify/fsnotify v1.4.9
+	github.com/go-asn1-ber/asn1-ber v1.5.5
+	github.com/go-ldap/ldap/v3 v3.4.8
+	github.com/gorilla/websocket v1.5.3
 	github.com/miekg/dns v1.1.33
+	github.com/quic-go/quic-go v0.54.0
+	github.com/razzie/babble v0.0.0-20201015224220-210f32b7a231
+	github.com/xtaci/smux v1.5.14
+	golang.org/x/crypto v0.26.0
+	golang.org/x/net v0.28.0
+	golang.org/x/sys v0.23.0
+	golang.org/x/time v0.5.0
+	gvisor.dev/gvisor v0.0.0-20240722211153-64c016c92987
+)
+
+require (
+	github.com/Azure/go-ntlmssp v0.0.0-20221128193559-754e69321358 // indirect
+	github.com/google/btree v1.1.2 // indirect
+	github.com/google/uuid v1.6.0 // indirect
 	github.com/onsi/ginkgo v1.14.2 // indirect
 	github.com/onsi/gomega v1.10.3 // indirect
-	github.com/razzie/babble v0.0.0-20201015224220-210f32b7a231
 	github.com/tjarratt/babble v0.0.0-20191209142150-eecdf8c2339d // indirect
-	github.com/xtaci/smux v1.5.14
-	golang.org/x/crypto v0.0.0-20200622213623-75b288015ac9
-	golang.org/x/time v0.0.0-20200630173020-3af7569d3a1e
+	go.uber.org/mock v0.5.0 // indirect
+	golang.org/x/mod v0.18.0 // indirect
+	golang.org/x/sync v0.8.0 // indirect
+	golang.org/x/term v0.23.0 // indirect
+	golang.org/x/tools v0.22.0 // indirect
 )
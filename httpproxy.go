@@ -0,0 +1,73 @@
+package razproxy
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// dialHTTPProxy connects to addr through an HTTP CONNECT proxy
+//
+// The proxy URL may contain credentials for basic authentication,
+// and the https scheme makes the connection to the proxy use TLS.
+func dialHTTPProxy(proxyURL *url.URL, addr string) (net.Conn, error) {
+	proxyAddr := proxyURL.Host
+	if len(proxyURL.Port()) == 0 {
+		if proxyURL.Scheme == "https" {
+			proxyAddr = net.JoinHostPort(proxyURL.Hostname(), "443")
+		} else {
+			proxyAddr = net.JoinHostPort(proxyURL.Hostname(), "80")
+		}
+	}
+
+	var conn net.Conn
+	var err error
+	switch proxyURL.Scheme {
+	case "http":
+		conn, err = net.DialTimeout("tcp", proxyAddr, 10*time.Second)
+	case "https":
+		conn, err = tls.DialWithDialer(&net.Dialer{Timeout: 10 * time.Second}, "tcp", proxyAddr, &tls.Config{
+			ServerName: proxyURL.Hostname(),
+		})
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme: %s", proxyURL.Scheme)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if proxyURL.User != nil {
+		pw, _ := proxyURL.User.Password()
+		auth := base64.StdEncoding.EncodeToString([]byte(proxyURL.User.Username() + ":" + pw))
+		req.Header.Set("Proxy-Authorization", "Basic "+auth)
+	}
+
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	bufConn := newBufferedConn(conn)
+	resp, err := http.ReadResponse(bufConn.r, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		conn.Close()
+		return nil, fmt.Errorf("proxy error: %s", resp.Status)
+	}
+	conn.SetDeadline(time.Time{})
+	return bufConn, nil
+}
@@ -0,0 +1,288 @@
+package razproxy
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// JWTAuthenticator validates JWTs with the public keys of an identity provider
+//
+// The keys are fetched from the JWKS URL and cached for an hour. Tokens signed
+// by an unknown key cause a refetch, at most once a minute.
+type JWTAuthenticator struct {
+	JWKSURL   string
+	Issuer    string // checked if not empty
+	Audience  string // checked if not empty
+	UserClaim string // claim that contains the user name ("sub" by default)
+	Leeway    time.Duration
+	mtx       sync.Mutex
+	keys      map[string]crypto.PublicKey
+	fetched   time.Time
+}
+
+// NewJWTAuthenticator returns a new JWTAuthenticator
+func NewJWTAuthenticator(jwksURL, issuer, audience string) *JWTAuthenticator {
+	return &JWTAuthenticator{
+		JWKSURL:   jwksURL,
+		Issuer:    issuer,
+		Audience:  audience,
+		UserClaim: "sub",
+		Leeway:    time.Minute,
+	}
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// ValidToken ...
+func (auth *JWTAuthenticator) ValidToken(token string) (string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", invalidCredentialsf("malformed JWT")
+	}
+	var header jwtHeader
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return "", err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", invalidCredentialsf("malformed JWT signature")
+	}
+	key, err := auth.key(header.Kid)
+	if err != nil {
+		return "", err
+	}
+	if err := verifyJWT(header.Alg, key, parts[0]+"."+parts[1], sig); err != nil {
+		return "", err
+	}
+
+	var claims map[string]interface{}
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return "", err
+	}
+	return auth.checkClaims(claims)
+}
+
+func (auth *JWTAuthenticator) checkClaims(claims map[string]interface{}) (string, error) {
+	if len(auth.Issuer) > 0 && claims["iss"] != auth.Issuer {
+		return "", invalidCredentialsf("JWT issuer mismatch: %v", claims["iss"])
+	}
+	if len(auth.Audience) > 0 && !hasAudience(claims["aud"], auth.Audience) {
+		return "", invalidCredentialsf("JWT audience mismatch: %v", claims["aud"])
+	}
+
+	userClaim := auth.UserClaim
+	if len(userClaim) == 0 {
+		userClaim = "sub"
+	}
+	user, ok := claims[userClaim].(string)
+	if !ok || len(user) == 0 {
+		return "", invalidCredentialsf("JWT has no %s claim", userClaim)
+	}
+
+	// the validity is checked last, so expired tokens are only accepted on Reload if the rest is still valid
+	now := time.Now()
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(auth.Leeway).Before(time.Unix(int64(nbf), 0)) {
+		return "", invalidCredentialsf("JWT not valid yet")
+	}
+	if exp, ok := claims["exp"].(float64); !ok {
+		return "", invalidCredentialsf("JWT has no exp claim")
+	} else if now.After(time.Unix(int64(exp), 0).Add(auth.Leeway)) {
+		return "", tokenExpiredf("JWT expired")
+	}
+	return user, nil
+}
+
+func hasAudience(aud interface{}, audience string) bool {
+	switch aud := aud.(type) {
+	case string:
+		return aud == audience
+	case []interface{}:
+		for _, a := range aud {
+			if a == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return invalidCredentialsf("malformed JWT: %v", err)
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return invalidCredentialsf("malformed JWT: %v", err)
+	}
+	return nil
+}
+
+// key returns the public key with the given ID, fetching the JWKS if needed
+func (auth *JWTAuthenticator) key(kid string) (crypto.PublicKey, error) {
+	auth.mtx.Lock()
+	defer auth.mtx.Unlock()
+
+	key, ok := auth.keys[kid]
+	age := time.Since(auth.fetched)
+	if (!ok && age > time.Minute) || age > time.Hour {
+		keys, err := fetchJWKS(auth.JWKSURL)
+		if err != nil {
+			if ok {
+				return key, nil // keep using the cached key if the identity provider is unavailable
+			}
+			return nil, err
+		}
+		auth.keys, auth.fetched = keys, time.Now()
+		key, ok = keys[kid]
+	}
+	if !ok {
+		return nil, invalidCredentialsf("unknown JWT key ID: %s", kid)
+	}
+	return key, nil
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func fetchJWKS(url string) (map[string]crypto.PublicKey, error) {
+	resp, err := (&http.Client{Timeout: 10 * time.Second}).Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("JWKS error: %s", resp.Status)
+	}
+
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return nil, err
+	}
+	keys := make(map[string]crypto.PublicKey)
+	for _, k := range set.Keys {
+		if len(k.Use) > 0 && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			continue // unsupported key types are skipped
+		}
+		keys[k.Kid] = key
+	}
+	return keys, nil
+}
+
+func (k *jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve: %s", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{
+			Curve: curve,
+			X:     new(big.Int).SetBytes(x),
+			Y:     new(big.Int).SetBytes(y),
+		}, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type: %s", k.Kty)
+	}
+}
+
+// verifyJWT checks the signature of a JWT (RS256/384/512 and ES256/384/512)
+func verifyJWT(alg string, key crypto.PublicKey, signed string, sig []byte) error {
+	var hash crypto.Hash
+	if len(alg) == 5 {
+		switch alg[2:] {
+		case "256":
+			hash = crypto.SHA256
+		case "384":
+			hash = crypto.SHA384
+		case "512":
+			hash = crypto.SHA512
+		}
+	}
+	if hash == 0 {
+		return invalidCredentialsf("unsupported JWT algorithm: %s", alg)
+	}
+	h := hash.New()
+	h.Write([]byte(signed))
+	digest := h.Sum(nil)
+
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		if alg[:2] != "RS" {
+			return invalidCredentialsf("JWT algorithm %s does not match the RSA key", alg)
+		}
+		if err := rsa.VerifyPKCS1v15(key, hash, digest, sig); err != nil {
+			return invalidCredentialsf("invalid JWT signature")
+		}
+	case *ecdsa.PublicKey:
+		if alg[:2] != "ES" {
+			return invalidCredentialsf("JWT algorithm %s does not match the EC key", alg)
+		}
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if len(sig) != 2*size {
+			return invalidCredentialsf("invalid JWT signature")
+		}
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(key, digest, r, s) {
+			return invalidCredentialsf("invalid JWT signature")
+		}
+	default:
+		return invalidCredentialsf("unsupported JWT key")
+	}
+	return nil
+}
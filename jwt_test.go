@@ -0,0 +1,223 @@
+package razproxy
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testIdP serves the public keys of a JWKS and signs tokens with the private keys
+type testIdP struct {
+	*httptest.Server
+	mtx     sync.Mutex
+	keys    map[string]crypto.Signer
+	fetches int32
+}
+
+func newTestIdP(t *testing.T) *testIdP {
+	idp := &testIdP{keys: make(map[string]crypto.Signer)}
+	idp.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&idp.fetches, 1)
+		idp.mtx.Lock()
+		defer idp.mtx.Unlock()
+		var set struct {
+			Keys []jwk `json:"keys"`
+		}
+		for kid, key := range idp.keys {
+			set.Keys = append(set.Keys, publicJWK(kid, key.Public()))
+		}
+		json.NewEncoder(w).Encode(&set)
+	}))
+	t.Cleanup(idp.Close)
+	return idp
+}
+
+func (idp *testIdP) addKey(t *testing.T, kid, kty string) {
+	var key crypto.Signer
+	var err error
+	if kty == "RSA" {
+		key, err = rsa.GenerateKey(rand.Reader, 2048)
+	} else {
+		key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	idp.mtx.Lock()
+	idp.keys[kid] = key
+	idp.mtx.Unlock()
+}
+
+func publicJWK(kid string, key crypto.PublicKey) jwk {
+	enc := base64.RawURLEncoding.EncodeToString
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		return jwk{Kty: "RSA", Kid: kid, N: enc(key.N.Bytes()), E: enc(big.NewInt(int64(key.E)).Bytes())}
+	case *ecdsa.PublicKey:
+		return jwk{Kty: "EC", Kid: kid, Crv: "P-256", X: enc(key.X.FillBytes(make([]byte, 32))), Y: enc(key.Y.FillBytes(make([]byte, 32)))}
+	}
+	panic("unsupported key")
+}
+
+// sign returns a JWT with the claims signed by the key with the given ID using alg
+func (idp *testIdP) sign(t *testing.T, alg, kid string, claims map[string]interface{}) string {
+	idp.mtx.Lock()
+	key := idp.keys[kid]
+	idp.mtx.Unlock()
+
+	header, _ := json.Marshal(&jwtHeader{Alg: alg, Kid: kid})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+
+	var sig []byte
+	var err error
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		sig, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	case *ecdsa.PrivateKey:
+		var r, s *big.Int
+		r, s, err = ecdsa.Sign(rand.Reader, key, digest[:])
+		if err == nil {
+			sig = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+		}
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func testClaims(overrides map[string]interface{}) map[string]interface{} {
+	claims := map[string]interface{}{
+		"sub": "alice",
+		"iss": "https://idp.example",
+		"aud": []string{"razproxy", "other"},
+		"exp": time.Now().Add(time.Hour).Unix(),
+	}
+	for k, v := range overrides {
+		if v == nil {
+			delete(claims, k)
+		} else {
+			claims[k] = v
+		}
+	}
+	return claims
+}
+
+func TestJWTAuthenticator(t *testing.T) {
+	idp := newTestIdP(t)
+	idp.addKey(t, "rsa", "RSA")
+	idp.addKey(t, "ec", "EC")
+	auth := NewJWTAuthenticator(idp.URL, "https://idp.example", "razproxy")
+
+	tests := []struct {
+		name    string
+		alg     string
+		kid     string
+		claims  map[string]interface{}
+		expired bool
+		valid   bool
+	}{
+		{name: "RS256", alg: "RS256", kid: "rsa", valid: true},
+		{name: "ES256", alg: "ES256", kid: "ec", valid: true},
+		{name: "EC alg with RSA key", alg: "ES256", kid: "rsa"},
+		{name: "RSA alg with EC key", alg: "RS256", kid: "ec"},
+		{name: "unsupported alg", alg: "HS256", kid: "rsa"},
+		{name: "expired", alg: "RS256", kid: "rsa", claims: map[string]interface{}{"exp": time.Now().Add(-time.Hour).Unix()}, expired: true},
+		{name: "expired within leeway", alg: "RS256", kid: "rsa", claims: map[string]interface{}{"exp": time.Now().Add(-30 * time.Second).Unix()}, valid: true},
+		{name: "no exp", alg: "RS256", kid: "rsa", claims: map[string]interface{}{"exp": nil}},
+		{name: "not valid yet", alg: "ES256", kid: "ec", claims: map[string]interface{}{"nbf": time.Now().Add(time.Hour).Unix()}},
+		{name: "issuer mismatch", alg: "RS256", kid: "rsa", claims: map[string]interface{}{"iss": "https://evil.example"}},
+		{name: "audience mismatch", alg: "RS256", kid: "rsa", claims: map[string]interface{}{"aud": "other"}},
+		{name: "no subject", alg: "ES256", kid: "ec", claims: map[string]interface{}{"sub": nil}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			user, err := auth.ValidToken(idp.sign(t, tt.alg, tt.kid, testClaims(tt.claims)))
+			if tt.valid {
+				if err != nil || user != "alice" {
+					t.Fatalf("expected alice, got %q, %v", user, err)
+				}
+				return
+			}
+			if !errors.Is(err, ErrInvalidCredentials) {
+				t.Fatalf("expected invalid credentials, got %q, %v", user, err)
+			}
+			if errors.Is(err, ErrTokenExpired) != tt.expired {
+				t.Fatalf("unexpected expiry: %v", err)
+			}
+		})
+	}
+}
+
+func TestJWTAuthenticatorTamper(t *testing.T) {
+	idp := newTestIdP(t)
+	idp.addKey(t, "rsa", "RSA")
+	auth := NewJWTAuthenticator(idp.URL, "", "")
+
+	token := idp.sign(t, "RS256", "rsa", testClaims(nil))
+	payload, _ := json.Marshal(testClaims(map[string]interface{}{"sub": "mallory"}))
+	parts := strings.Split(token, ".")
+	tampered := parts[0] + "." + base64.RawURLEncoding.EncodeToString(payload) + "." + parts[2]
+	if _, err := auth.ValidToken(tampered); !errors.Is(err, ErrInvalidCredentials) {
+		t.Fatalf("tampered token accepted: %v", err)
+	}
+}
+
+func TestJWTAuthenticatorKeyRotation(t *testing.T) {
+	idp := newTestIdP(t)
+	idp.addKey(t, "old", "RSA")
+	auth := NewJWTAuthenticator(idp.URL, "", "")
+
+	if _, err := auth.ValidToken(idp.sign(t, "RS256", "old", testClaims(nil))); err != nil {
+		t.Fatal(err)
+	}
+	idp.addKey(t, "new", "EC")
+	token := idp.sign(t, "ES256", "new", testClaims(nil))
+
+	// unknown keys are refetched at most once a minute
+	if _, err := auth.ValidToken(token); !errors.Is(err, ErrInvalidCredentials) {
+		t.Fatalf("expected unknown key ID, got %v", err)
+	}
+	if n := atomic.LoadInt32(&idp.fetches); n != 1 {
+		t.Fatalf("expected 1 fetch, got %d", n)
+	}
+
+	auth.mtx.Lock()
+	auth.fetched = time.Now().Add(-2 * time.Minute)
+	auth.mtx.Unlock()
+	if user, err := auth.ValidToken(token); err != nil || user != "alice" {
+		t.Fatalf("expected alice after refetch, got %q, %v", user, err)
+	}
+	if n := atomic.LoadInt32(&idp.fetches); n != 2 {
+		t.Fatalf("expected 2 fetches, got %d", n)
+	}
+}
+
+func TestJWTAuthenticatorUnavailable(t *testing.T) {
+	idp := newTestIdP(t)
+	idp.addKey(t, "rsa", "RSA")
+	auth := NewJWTAuthenticator(idp.URL, "", "")
+	token := idp.sign(t, "RS256", "rsa", testClaims(nil))
+	idp.Close()
+
+	// errors of the identity provider are backend errors, not invalid credentials
+	if _, err := auth.ValidToken(token); err == nil || errors.Is(err, ErrInvalidCredentials) {
+		t.Fatalf("expected backend error, got %v", err)
+	}
+}
@@ -0,0 +1,243 @@
+package razproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// LDAPAuthenticator validates users by binding to an LDAP directory with their password
+//
+// The user is looked up with the service account first, then its DN is bound
+// with the given password. Connections are pooled and successful logins are
+// cached for CacheTTL.
+type LDAPAuthenticator struct {
+	URL            string // ldap://host:389 or ldaps://host:636
+	BindDN         string // service account that searches users (anonymous if empty)
+	BindPassword   string
+	BaseDN         string
+	UserFilter     string   // search filter of users, %s is replaced by the escaped user name
+	GroupAttribute string   // attribute of users that lists their groups
+	RequiredGroups []string // users have to be member of any of these groups if not empty
+	GroupPolicies  []GroupPolicy
+	StartTLS       bool
+	TLSConfig      *tls.Config
+	Timeout        time.Duration
+	PoolSize       int
+	CacheTTL       time.Duration
+	Logger         *log.Logger // logs the reasons of rejections that are not reported to clients
+	poolOnce       sync.Once
+	pool           chan *ldap.Conn
+	cache          authCache
+}
+
+// GroupPolicy assigns a policy to the members of a group
+//
+// Group is either a DN or the value of the first RDN, e.g. cn=staff,ou=groups,dc=example,dc=com or staff.
+type GroupPolicy struct {
+	Group  string `json:"group"`
+	Policy string `json:"policy"`
+}
+
+// NewLDAPAuthenticator returns a new LDAPAuthenticator with default settings
+func NewLDAPAuthenticator(url, baseDN string) *LDAPAuthenticator {
+	return &LDAPAuthenticator{
+		URL:            url,
+		BaseDN:         baseDN,
+		UserFilter:     "(uid=%s)",
+		GroupAttribute: "memberOf",
+		Timeout:        10 * time.Second,
+		PoolSize:       4,
+		CacheTTL:       5 * time.Minute,
+	}
+}
+
+// Authenticate ...
+func (auth *LDAPAuthenticator) Authenticate(ctx context.Context, req AuthRequest) (Identity, error) {
+	if req.CredentialType != CredentialPassword {
+		return Identity{}, invalidCredentialsf("unsupported credential type: %s", req.CredentialType)
+	}
+	if len(req.User) == 0 || len(req.Password) == 0 {
+		return Identity{}, ErrInvalidCredentials // an empty password would be an unauthenticated bind
+	}
+	if id, ok := auth.cache.get(req.User, req.Password); ok {
+		return id, nil
+	}
+	return withContext(ctx, func() (Identity, error) {
+		id, err := auth.authenticate(req.User, req.Password)
+		if err != nil {
+			return Identity{}, err
+		}
+		auth.cache.put(req.User, req.Password, id, auth.CacheTTL)
+		return id, nil
+	})
+}
+
+func (auth *LDAPAuthenticator) authenticate(user, password string) (Identity, error) {
+	conn, err := auth.get()
+	if err != nil {
+		return Identity{}, err
+	}
+	broken := true
+	defer func() {
+		auth.put(conn, broken)
+	}()
+
+	if len(auth.BindDN) > 0 {
+		err = conn.Bind(auth.BindDN, auth.BindPassword)
+	} else {
+		err = conn.UnauthenticatedBind("")
+	}
+	if err != nil {
+		return Identity{}, err
+	}
+
+	res, err := conn.Search(ldap.NewSearchRequest(
+		auth.BaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, int(auth.Timeout/time.Second), false,
+		fmt.Sprintf(auth.UserFilter, ldap.EscapeFilter(user)),
+		[]string{"dn", auth.GroupAttribute},
+		nil,
+	))
+	if err != nil {
+		return Identity{}, err
+	}
+	broken = false
+	if len(res.Entries) != 1 {
+		return Identity{}, ErrInvalidCredentials // don't tell clients whether the user exists
+	}
+	entry := res.Entries[0]
+
+	if err := conn.Bind(entry.DN, password); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return Identity{}, ErrInvalidCredentials
+		}
+		broken = true
+		return Identity{}, err
+	}
+
+	return auth.identity(user, entry.DN, entry.GetAttributeValues(auth.GroupAttribute))
+}
+
+// CheckIdentity checks the groups of a user accepted earlier against RequiredGroups
+// and GroupPolicies, without querying the directory
+func (auth *LDAPAuthenticator) CheckIdentity(id Identity, password func(string) bool) (Identity, error) {
+	dn := id.Attributes["dn"]
+	if len(dn) == 0 {
+		return Identity{}, ErrInvalidCredentials // not a user of a directory
+	}
+	return auth.identity(id.User, dn, id.Groups)
+}
+
+// identity returns the identity of a user with the policy of its groups, or
+// ErrInvalidCredentials if it is not a member of the required groups
+func (auth *LDAPAuthenticator) identity(user, dn string, groups []string) (Identity, error) {
+	if len(auth.RequiredGroups) > 0 && !memberOfAny(groups, auth.RequiredGroups...) {
+		// the client is not told, because it would reveal that the password is correct
+		if auth.Logger != nil {
+			auth.Logger.Println("LDAP user", user, "is not a member of the required groups")
+		}
+		return Identity{}, ErrInvalidCredentials
+	}
+	id := Identity{
+		User:       user,
+		Groups:     groups,
+		Attributes: map[string]string{"dn": dn},
+	}
+	for _, gp := range auth.GroupPolicies {
+		if memberOfAny(groups, gp.Group) {
+			id.Policy = gp.Policy
+			break
+		}
+	}
+	return id, nil
+}
+
+func memberOfAny(groups []string, wanted ...string) bool {
+	for _, group := range groups {
+		dn, err := ldap.ParseDN(group)
+		for _, w := range wanted {
+			if strings.EqualFold(group, w) {
+				return true
+			}
+			if err == nil && len(dn.RDNs) > 0 && len(dn.RDNs[0].Attributes) > 0 && strings.EqualFold(dn.RDNs[0].Attributes[0].Value, w) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Close closes the pooled connections
+func (auth *LDAPAuthenticator) Close() error {
+	auth.poolOnce.Do(func() {
+		auth.pool = make(chan *ldap.Conn, auth.PoolSize)
+	})
+	for {
+		select {
+		case conn := <-auth.pool:
+			conn.Close()
+		default:
+			return nil
+		}
+	}
+}
+
+// get returns a pooled connection or dials a new one
+func (auth *LDAPAuthenticator) get() (*ldap.Conn, error) {
+	auth.poolOnce.Do(func() {
+		auth.pool = make(chan *ldap.Conn, auth.PoolSize)
+	})
+	for {
+		select {
+		case conn := <-auth.pool:
+			if conn.IsClosing() {
+				conn.Close()
+				continue
+			}
+			return conn, nil
+		default:
+			return auth.dial()
+		}
+	}
+}
+
+// put returns a connection to the pool, unless it's broken or the pool is full
+func (auth *LDAPAuthenticator) put(conn *ldap.Conn, broken bool) {
+	if broken {
+		conn.Close()
+		return
+	}
+	select {
+	case auth.pool <- conn:
+	default:
+		conn.Close()
+	}
+}
+
+func (auth *LDAPAuthenticator) dial() (*ldap.Conn, error) {
+	conn, err := ldap.DialURL(auth.URL,
+		ldap.DialWithDialer(&net.Dialer{Timeout: auth.Timeout}),
+		ldap.DialWithTLSConfig(auth.TLSConfig))
+	if err != nil {
+		return nil, err
+	}
+	conn.SetTimeout(auth.Timeout)
+	if auth.StartTLS {
+		tlsConf := auth.TLSConfig
+		if tlsConf == nil {
+			tlsConf = &tls.Config{}
+		}
+		if err := conn.StartTLS(tlsConf); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
@@ -0,0 +1,206 @@
+package razproxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+)
+
+// testLDAPEntry is a user of testLDAPServer
+type testLDAPEntry struct {
+	dn       string
+	password string
+	groups   []string
+}
+
+// testLDAPServer answers the simple binds and searches of LDAPAuthenticator
+type testLDAPServer struct {
+	ln      net.Listener
+	bindDN  string
+	bindPW  string
+	entries map[string]testLDAPEntry // entries per search filter
+}
+
+func newTestLDAPServer(t *testing.T) *testLDAPServer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	srv := &testLDAPServer{
+		ln:     ln,
+		bindDN: "cn=svc,dc=example",
+		bindPW: "svc-pw",
+		entries: map[string]testLDAPEntry{
+			"(uid=erin)": {
+				dn:       "uid=erin,ou=people,dc=example",
+				password: "erin-pw",
+				groups:   []string{"cn=staff,ou=groups,dc=example", "cn=vpn,ou=groups,dc=example"},
+			},
+			"(uid=frank)": {
+				dn:       "uid=frank,ou=people,dc=example",
+				password: "frank-pw",
+				groups:   []string{"cn=other,ou=groups,dc=example"},
+			},
+		},
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go srv.serve(conn)
+		}
+	}()
+	return srv
+}
+
+func (srv *testLDAPServer) authenticator(t *testing.T) *LDAPAuthenticator {
+	auth := NewLDAPAuthenticator("ldap://"+srv.ln.Addr().String(), "dc=example")
+	auth.BindDN = srv.bindDN
+	auth.BindPassword = srv.bindPW
+	auth.CacheTTL = 0
+	t.Cleanup(func() { auth.Close() })
+	return auth
+}
+
+func (srv *testLDAPServer) serve(conn net.Conn) {
+	defer conn.Close()
+	for {
+		packet, err := ber.ReadPacket(conn)
+		if err != nil || len(packet.Children) < 2 {
+			return
+		}
+		msgID := packet.Children[0].Value
+		op := packet.Children[1]
+		switch op.Tag {
+		case ldap.ApplicationBindRequest:
+			dn := op.Children[1].Data.String()
+			password := op.Children[2].Data.String()
+			code := ldap.LDAPResultInvalidCredentials
+			if (dn == srv.bindDN && password == srv.bindPW) || (srv.hasUser(dn, password) && len(password) > 0) {
+				code = ldap.LDAPResultSuccess
+			}
+			conn.Write(ldapResponse(msgID, ldap.ApplicationBindResponse, code).Bytes())
+		case ldap.ApplicationSearchRequest:
+			filter, _ := ldap.DecompileFilter(op.Children[6])
+			if entry, ok := srv.entries[filter]; ok {
+				conn.Write(ldapEntry(msgID, entry).Bytes())
+			}
+			conn.Write(ldapResponse(msgID, ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess).Bytes())
+		default:
+			return
+		}
+	}
+}
+
+func (srv *testLDAPServer) hasUser(dn, password string) bool {
+	for _, entry := range srv.entries {
+		if entry.dn == dn && entry.password == password {
+			return true
+		}
+	}
+	return false
+}
+
+func ldapMessage(msgID interface{}, op *ber.Packet) *ber.Packet {
+	packet := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Response")
+	packet.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, msgID, "Message ID"))
+	packet.AppendChild(op)
+	return packet
+}
+
+func ldapResponse(msgID interface{}, tag ber.Tag, code int) *ber.Packet {
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "Response")
+	op.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, int64(code), "Result Code"))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Matched DN"))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Diagnostic Message"))
+	return ldapMessage(msgID, op)
+}
+
+func ldapEntry(msgID interface{}, entry testLDAPEntry) *ber.Packet {
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchResultEntry, nil, "Search Result Entry")
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, entry.dn, "DN"))
+	attrs := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Attributes")
+	attr := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Attribute")
+	attr.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "memberOf", "Type"))
+	values := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "Values")
+	for _, group := range entry.groups {
+		values.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, group, "Value"))
+	}
+	attr.AppendChild(values)
+	attrs.AppendChild(attr)
+	op.AppendChild(attrs)
+	return ldapMessage(msgID, op)
+}
+
+func TestLDAPAuthenticator(t *testing.T) {
+	srv := newTestLDAPServer(t)
+	auth := srv.authenticator(t)
+	auth.GroupPolicies = []GroupPolicy{
+		{Group: "cn=admins,ou=groups,dc=example", Policy: "admin"},
+		{Group: "vpn", Policy: "vpn"},
+		{Group: "staff", Policy: "staff"},
+	}
+
+	id, err := auth.Authenticate(context.Background(), AuthRequest{User: "erin", Password: "erin-pw"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id.User != "erin" || id.Policy != "vpn" || len(id.Groups) != 2 || id.Attributes["dn"] != "uid=erin,ou=people,dc=example" {
+		t.Fatalf("unexpected identity: %+v", id)
+	}
+	id, err = auth.Authenticate(context.Background(), AuthRequest{User: "frank", Password: "frank-pw"})
+	if err != nil || id.Policy != "" {
+		t.Fatalf("expected frank without policy, got %+v, %v", id, err)
+	}
+
+	tests := []struct {
+		name     string
+		user     string
+		password string
+	}{
+		{name: "wrong password", user: "erin", password: "wrong"},
+		{name: "unknown user", user: "mallory", password: "erin-pw"},
+		{name: "empty password", user: "erin", password: ""},
+		{name: "filter injection", user: "*", password: "erin-pw"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := auth.Authenticate(context.Background(), AuthRequest{User: tt.user, Password: tt.password})
+			if !errors.Is(err, ErrInvalidCredentials) {
+				t.Fatalf("expected invalid credentials, got %v", err)
+			}
+		})
+	}
+}
+
+func TestLDAPAuthenticatorRequiredGroups(t *testing.T) {
+	srv := newTestLDAPServer(t)
+	auth := srv.authenticator(t)
+	auth.RequiredGroups = []string{"cn=vpn,ou=groups,dc=example"}
+
+	if _, err := auth.Authenticate(context.Background(), AuthRequest{User: "erin", Password: "erin-pw"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := auth.Authenticate(context.Background(), AuthRequest{User: "frank", Password: "frank-pw"}); !errors.Is(err, ErrInvalidCredentials) {
+		t.Fatalf("expected invalid credentials, got %v", err)
+	}
+}
+
+func TestLDAPAuthenticatorServiceAccount(t *testing.T) {
+	srv := newTestLDAPServer(t)
+	auth := srv.authenticator(t)
+	auth.BindPassword = "wrong"
+
+	// a misconfigured service account is a backend error, so clients may retry later
+	_, err := auth.Authenticate(context.Background(), AuthRequest{User: "erin", Password: "erin-pw"})
+	if err == nil || errors.Is(err, ErrInvalidCredentials) {
+		t.Fatalf("expected backend error, got %v", err)
+	}
+}
@@ -0,0 +1,83 @@
+package razproxy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+)
+
+// AddListener starts listening on the given address in the background
+//
+// The address may be prefixed by the name of a transport (see ListenAndServe),
+// or by quic:// to accept QUIC connections. All listeners share the server's
+// authentication, sessions and DNS settings.
+func (s *Server) AddListener(address string) error {
+	s.listenersMtx.Lock()
+	defer s.listenersMtx.Unlock()
+	if _, ok := s.listeners[address]; ok {
+		return fmt.Errorf("already listening on %s", address)
+	}
+
+	var ln io.Closer
+	var serve func() error
+	if name, addr := splitTransport(address); name == TransportQUIC {
+		quicLn, err := s.listenQUIC(addr)
+		if err != nil {
+			return err
+		}
+		ln = quicLn
+		serve = func() error { return s.serveQUIC(quicLn) }
+	} else {
+		l, err := s.Listen(address)
+		if err != nil {
+			return err
+		}
+		ln = l
+		serve = func() error { return s.Serve(l) }
+	}
+	s.listeners[address] = ln
+
+	go func() {
+		err := serve()
+		s.listenersMtx.Lock()
+		removed := s.listeners[address] != ln
+		if !removed {
+			delete(s.listeners, address)
+		}
+		s.listenersMtx.Unlock()
+		if !removed || !errors.Is(err, net.ErrClosed) {
+			s.Logger.Println("listener", address, "stopped:", err)
+		}
+	}()
+
+	s.Logger.Println("listening on", address)
+	return nil
+}
+
+// RemoveListener stops listening on the given address
+//
+// Sessions accepted by the listener are kept alive.
+func (s *Server) RemoveListener(address string) error {
+	s.listenersMtx.Lock()
+	ln, ok := s.listeners[address]
+	delete(s.listeners, address)
+	s.listenersMtx.Unlock()
+	if !ok {
+		return fmt.Errorf("not listening on %s", address)
+	}
+	return ln.Close()
+}
+
+// Listeners returns the addresses the server is listening on
+func (s *Server) Listeners() []string {
+	s.listenersMtx.Lock()
+	defer s.listenersMtx.Unlock()
+	addrs := make([]string, 0, len(s.listeners))
+	for addr := range s.listeners {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	return addrs
+}
@@ -0,0 +1,142 @@
+package razproxy
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// runInNetNS runs the test in a new network namespace by running the test
+// binary again under unshare. It returns true in the namespace, where the test
+// goes on, and false in the parent process, which has nothing more to do.
+func runInNetNS(t *testing.T) bool {
+	if os.Getenv("RAZPROXY_NETNS") == t.Name() {
+		ipTest(t, "link", "set", "lo", "up")
+		return true
+	}
+	if os.Geteuid() != 0 {
+		t.Skip("network namespaces need root")
+	}
+	for _, cmd := range []string{"unshare", "ip"} {
+		if _, err := exec.LookPath(cmd); err != nil {
+			t.Skip(cmd, "not found")
+		}
+	}
+	cmd := exec.Command("unshare", "--net", os.Args[0], "-test.run", "^"+t.Name()+"$", "-test.v")
+	cmd.Env = append(os.Environ(), "RAZPROXY_NETNS="+t.Name())
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("test failed in network namespace: %v\n%s", err, out)
+	}
+	if bytes.Contains(out, []byte("--- SKIP")) {
+		t.Skipf("skipped in network namespace:\n%s", out)
+	}
+	return false
+}
+
+func ipTest(t *testing.T, args ...string) {
+	if out, err := exec.Command("ip", args...).CombinedOutput(); err != nil {
+		t.Fatalf("ip %s: %v: %s", strings.Join(args, " "), err, out)
+	}
+}
+
+// testOutbound connects every destination to the same address and records them
+type testOutbound struct {
+	addr  string
+	mtx   sync.Mutex
+	dests []string
+}
+
+func (o *testOutbound) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	o.mtx.Lock()
+	o.dests = append(o.dests, addr)
+	o.mtx.Unlock()
+	var d net.Dialer
+	return d.DialContext(ctx, network, o.addr)
+}
+
+func (o *testOutbound) getDests() []string {
+	o.mtx.Lock()
+	defer o.mtx.Unlock()
+	return append([]string(nil), o.dests...)
+}
+
+// newTestEcho starts a TCP server that echoes what it reads
+func newTestEcho(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+// newTestClient returns a client connected to a server whose outbound sends
+// every stream to an echo server
+func newTestClient(t *testing.T) (*Client, *testOutbound) {
+	srv := newTestServer(t)
+	srv.LAN = true
+	outbound := &testOutbound{addr: newTestEcho(t)}
+	srv.Outbounds = map[string]Outbound{"test": outbound}
+	srv.Outbound = "test"
+
+	c, err := NewClient("", &ClientConfig{
+		PendingTimeout: 5 * time.Second,
+		Upstreams: []Upstream{{
+			Addr:      "test",
+			Transport: TransportPipe,
+			User:      "alice",
+			Password:  "alice-pw",
+			Dialer:    serveTest(srv),
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Logger = log.New(io.Discard, "", 0)
+	return c, outbound
+}
+
+// echoTest dials until it succeeds or the timeout passes, and checks that the data comes back
+func echoTest(t *testing.T, dial func() (net.Conn, error)) {
+	var conn net.Conn
+	var err error
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(50 * time.Millisecond) {
+		if conn, err = dial(); err == nil || time.Now().After(deadline) {
+			break
+		}
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	msg := []byte("hello")
+	if _, err := conn.Write(msg); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len(msg))
+	if _, err := io.ReadFull(conn, buf); err != nil || !bytes.Equal(buf, msg) {
+		t.Fatalf("unexpected echo: %q, %v", buf, err)
+	}
+}
@@ -0,0 +1,198 @@
+package razproxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/armon/go-socks5"
+	netproxy "golang.org/x/net/proxy"
+)
+
+// Outbound dials destinations on behalf of clients
+type Outbound interface {
+	DialContext(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// NewOutbound returns an Outbound based on a URL
+//
+// Supported schemes:
+//
+//	direct://?source=1.2.3.4&source=1.2.3.5&rotate=random&interface=eth1&fwmark=100
+//	socks5://user:pw@host:port
+//	http://user:pw@host:port (or https:// for TLS to the proxy)
+//	razproxy://user:pw@host:port?transport=ws&path=/ws&skip-tls-verify=true&secret=...
+func NewOutbound(rawurl string) (Outbound, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+
+	switch u.Scheme {
+	case "direct":
+		return newDirectOutbound(u)
+	case "socks5":
+		var auth *netproxy.Auth
+		if u.User != nil {
+			pw, _ := u.User.Password()
+			auth = &netproxy.Auth{User: u.User.Username(), Password: pw}
+		}
+		dialer, err := netproxy.SOCKS5("tcp", u.Host, auth, &net.Dialer{Timeout: 10 * time.Second})
+		if err != nil {
+			return nil, err
+		}
+		return dialer.(netproxy.ContextDialer), nil
+	case "http", "https":
+		return &httpOutbound{proxyURL: u}, nil
+	case "razproxy":
+		q := u.Query()
+		skipCertVerify, _ := strconv.ParseBool(q.Get("skip-tls-verify"))
+		conf := &ClientConfig{
+			SkipCertVerify: skipCertVerify,
+			Transport:      q.Get("transport"),
+			Path:           q.Get("path"),
+			Secret:         q.Get("secret"),
+		}
+		if u.User != nil {
+			conf.User = u.User.Username()
+			conf.Password, _ = u.User.Password()
+		}
+		c, err := NewClient(u.Host, conf)
+		if err != nil {
+			return nil, err
+		}
+		return &razproxyOutbound{client: c}, nil
+	default:
+		return nil, fmt.Errorf("unsupported outbound: %s", rawurl)
+	}
+}
+
+type httpOutbound struct {
+	proxyURL *url.URL
+}
+
+func (o *httpOutbound) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return dialHTTPProxy(o.proxyURL, addr)
+}
+
+// razproxyOutbound chains requests to another razproxy server
+type razproxyOutbound struct {
+	client *Client
+}
+
+func (o *razproxyOutbound) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	dest, err := parseAddrSpec(addr)
+	if err != nil {
+		return nil, err
+	}
+	return o.client.dial(dest)
+}
+
+type outboundKey struct{}
+
+// outboundRequest is stored in the request context by serverSession.Allow
+type outboundRequest struct {
+	outbound Outbound
+	addr     string
+}
+
+// pickOutbound returns the outbound for a request based on the server rules
+// and the outbound of the user, or false if the request is rejected
+func (s *serverSession) pickOutbound(dest *socks5.AddrSpec) (Outbound, bool) {
+	s.srv.settingsMtx.RLock()
+	rules := s.srv.Rules
+	s.srv.settingsMtx.RUnlock()
+
+	// the rules may resolve the destination, so the settings are not locked meanwhile
+	action := ActionProxy
+	if rules != nil {
+		action = rules.RouteLookup(dest, s.lookup)
+	}
+
+	user, policy, _ := s.identity()
+	s.srv.settingsMtx.RLock()
+	defer s.srv.settingsMtx.RUnlock()
+
+	var name string
+	switch action {
+	case ActionReject:
+		return nil, false
+	case ActionDirect:
+		return nil, true
+	case ActionProxy:
+		name = s.srv.UserOutbounds[user]
+		if len(name) == 0 && len(policy) > 0 {
+			name = s.srv.UserOutbounds["@"+policy]
+		}
+		if len(name) == 0 {
+			name = s.srv.Outbound
+		}
+		if len(name) == 0 {
+			return nil, true
+		}
+	default:
+		name = string(action)
+	}
+
+	outbound, ok := s.srv.Outbounds[name]
+	if !ok {
+		s.log("unknown outbound: ", name)
+		return nil, false
+	}
+	return outbound, true
+}
+
+// Dial connects to the destination through the outbound picked in Allow
+func (s *serverSession) Dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	user, policy, _ := s.identity()
+	req, _ := ctx.Value(outboundKey{}).(*outboundRequest)
+	if req == nil || req.outbound == nil {
+		conn, err := net.DialTimeout(network, addr, 10*time.Second)
+		if err != nil {
+			return nil, err
+		}
+		return s.track(addr, s.srv.throttle(user, policy, conn)), nil
+	}
+	conn, err := req.outbound.DialContext(ctx, network, req.addr)
+	if err != nil {
+		return nil, err
+	}
+	return s.track(req.addr, s.srv.throttle(user, policy, tcpAddrConn{conn})), nil
+}
+
+// tcpAddrConn makes sure LocalAddr returns a *net.TCPAddr as go-socks5 expects
+type tcpAddrConn struct {
+	net.Conn
+}
+
+func (c tcpAddrConn) LocalAddr() net.Addr {
+	if addr, ok := c.Conn.LocalAddr().(*net.TCPAddr); ok {
+		return addr
+	}
+	return &net.TCPAddr{IP: net.IPv4zero}
+}
+
+// CloseWrite keeps half-closing working through the wrapper
+func (c tcpAddrConn) CloseWrite() error {
+	return closeWrite(c.Conn)
+}
+
+// resolveLocally returns whether the server resolves the destination of the
+// outbound, as opposed to proxies that resolve domain names themselves
+func resolveLocally(outbound Outbound) bool {
+	_, ok := outbound.(*directOutbound)
+	return outbound == nil || ok
+}
+
+// outboundAddr returns the address to pass to the outbound, preferring the
+// domain name for proxies so they can apply their own policies
+func outboundAddr(outbound Outbound, dest *socks5.AddrSpec) string {
+	if !resolveLocally(outbound) && len(dest.FQDN) > 0 {
+		return net.JoinHostPort(strings.TrimSuffix(dest.FQDN, "."), strconv.Itoa(dest.Port))
+	}
+	return dest.Address()
+}
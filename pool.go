@@ -0,0 +1,129 @@
+package razproxy
+
+import (
+	"hash/fnv"
+	"sync/atomic"
+
+	"github.com/armon/go-socks5"
+)
+
+// PoolBalance determines how streams are spread over the sessions of a server
+type PoolBalance string
+
+// Supported pool balancing methods
+const (
+	PoolLeastLoaded PoolBalance = "least-loaded"
+	PoolHash        PoolBalance = "hash"
+)
+
+func (u *upstream) getSessions() []*clientSession {
+	u.mtx.RLock()
+	defer u.mtx.RUnlock()
+	return u.sessions
+}
+
+// pickSession returns the session to open a new stream for dest on
+// and opens a new session in the background if all of them are busy
+func (u *upstream) pickSession(dest *socks5.AddrSpec) *clientSession {
+	sessions := u.getSessions()
+	if len(sessions) == 0 {
+		return nil
+	}
+
+	conf := u.client.conf
+	var picked *clientSession
+	if conf.PoolBalance == PoolHash {
+		h := fnv.New32a()
+		if len(dest.FQDN) > 0 {
+			h.Write([]byte(dest.FQDN))
+		} else {
+			h.Write(dest.IP)
+		}
+		picked = sessions[h.Sum32()%uint32(len(sessions))]
+	} else {
+		for _, s := range sessions {
+			if picked == nil || s.load() < picked.load() {
+				picked = s
+			}
+		}
+	}
+
+	if len(sessions) < conf.PoolSize && picked.load() >= conf.PoolStreamsPerSession {
+		go u.grow()
+	}
+	return picked
+}
+
+// grow opens an additional session that shares the identity of the primary session
+func (u *upstream) grow() {
+	if !atomic.CompareAndSwapInt32(&u.growing, 0, 1) {
+		return
+	}
+	defer atomic.StoreInt32(&u.growing, 0)
+
+	sessions := u.getSessions()
+	if len(sessions) == 0 {
+		return
+	}
+	primary := sessions[0]
+	session, err := u.newSession(primary.id)
+	if err != nil {
+		u.client.Logger.Println("failed to open pooled session to", u.Addr+":", err)
+		return
+	}
+
+	u.mtx.Lock()
+	if len(u.sessions) == 0 || u.sessions[0] != primary {
+		u.mtx.Unlock()
+		session.Close()
+		return
+	}
+	u.sessions = append(u.sessions[:len(u.sessions):len(u.sessions)], session)
+	poolSize := len(u.sessions)
+	u.mtx.Unlock()
+	u.client.Logger.Printf("opened pooled session to %s (%d/%d)", u.Addr, poolSize, u.client.conf.PoolSize)
+}
+
+// shrink closes pooled sessions that have been idle since the last call
+func (u *upstream) shrink() {
+	u.mtx.Lock()
+	var idle []*clientSession
+	sessions := make([]*clientSession, 0, len(u.sessions))
+	for i, s := range u.sessions {
+		if i > 0 && s.load() == 0 {
+			if s.idle {
+				idle = append(idle, s)
+				continue
+			}
+			s.idle = true
+		} else {
+			s.idle = false
+		}
+		sessions = append(sessions, s)
+	}
+	u.sessions = sessions
+	u.mtx.Unlock()
+
+	for _, s := range idle {
+		s.Close()
+	}
+}
+
+// dropSession closes a broken session, or disconnects from the server if it's the primary session
+func (u *upstream) dropSession(session *clientSession) {
+	u.mtx.Lock()
+	if len(u.sessions) == 0 || u.sessions[0] == session {
+		u.mtx.Unlock()
+		u.disconnect()
+		return
+	}
+	sessions := make([]*clientSession, 0, len(u.sessions))
+	for _, s := range u.sessions {
+		if s != session {
+			sessions = append(sessions, s)
+		}
+	}
+	u.sessions = sessions
+	u.mtx.Unlock()
+	session.Close()
+}
@@ -0,0 +1,113 @@
+package razproxy
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"time"
+)
+
+// secretToken returns the preamble clients send before the tunnel when a pre-shared secret is configured
+func secretToken(secret string) []byte {
+	token := sha256.Sum256([]byte("razproxy:" + secret))
+	return token[:]
+}
+
+// serverTLSConfig returns the TLS config of listeners, which advertises
+// the razproxy ALPN protocol if the server requires it and uses the
+// session ticket key derived from SessionKey if set
+func (s *Server) serverTLSConfig() *tls.Config {
+	if !s.RequireALPN && len(s.SessionKey) == 0 {
+		return s.tlsConf
+	}
+	tlsConf := s.tlsConf.Clone()
+	if s.RequireALPN {
+		tlsConf.NextProtos = []string{razproxyALPN, "http/1.1"}
+	}
+	if len(s.SessionKey) > 0 {
+		tlsConf.SetSessionTicketKeys([][32]byte{s.sessionTicketKey()})
+	}
+	return tlsConf
+}
+
+// isTunnel checks if the connection belongs to a client based on the ALPN protocol,
+// the pre-shared secret and the smux header
+func (s *Server) isTunnel(conn net.Conn, header []byte) bool {
+	if s.RequireALPN {
+		tlsConn, ok := conn.(*tls.Conn)
+		if !ok || tlsConn.ConnectionState().NegotiatedProtocol != razproxyALPN {
+			return false
+		}
+	}
+	if len(s.Secret) > 0 {
+		token := secretToken(s.Secret)
+		return len(header) == len(token) && subtle.ConstantTimeCompare(header, token) == 1
+	}
+	return len(header) > 0 && (header[0] == 1 || header[0] == 2) // smux protocol version
+}
+
+// peekHeader returns the first n bytes of the connection, or fewer if the
+// first read is shorter
+//
+// Clients write the tunnel preamble at once, so a shorter first read can't be a
+// tunnel and probes don't have to wait for the read deadline. The bytes are not
+// compared here, because deciding byte by byte would reveal the secret.
+func peekHeader(conn *bufferedConn, n int) []byte {
+	if _, err := conn.Peek(1); err != nil {
+		return nil
+	}
+	if buffered := conn.r.Buffered(); buffered < n {
+		n = buffered
+	}
+	header, _ := conn.Peek(n)
+	return header
+}
+
+// checkSecret reads the pre-shared secret of the client if one is configured
+func (s *Server) checkSecret(r io.Reader) bool {
+	if len(s.Secret) == 0 {
+		return true
+	}
+	token := secretToken(s.Secret)
+	buf := make([]byte, len(token))
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare(buf, token) == 1
+}
+
+// fallback forwards a connection that doesn't belong to a client to the fallback backend
+//
+// If WebSocket tunnels are enabled, the connection is served by the HTTP server,
+// which forwards non-tunnel requests to the fallback backend instead.
+func (s *Server) fallback(conn net.Conn, httpLn *connListener) {
+	if len(s.Fallback) == 0 || len(s.WebSocketPath) > 0 {
+		httpLn.push(conn)
+		return
+	}
+
+	defer conn.Close()
+	backend, err := net.DialTimeout("tcp", s.Fallback, 10*time.Second)
+	if err != nil {
+		s.Logger.Println("fallback error:", err)
+		return
+	}
+	defer backend.Close()
+	relay(conn, backend)
+}
+
+// fallbackHandler returns the HTTP handler that forwards requests to the fallback backend
+func (s *Server) fallbackHandler() http.Handler {
+	s.fallbackOnce.Do(func() {
+		target := &url.URL{Scheme: "http", Host: s.Fallback}
+		proxy := httputil.NewSingleHostReverseProxy(target)
+		proxy.ErrorLog = s.Logger
+		s.fallbackProxy = proxy
+	})
+	return s.fallbackProxy
+}
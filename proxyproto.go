@@ -0,0 +1,218 @@
+package razproxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var proxyProtoV2Sig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyProtoListener accepts PROXY protocol v1/v2 headers from trusted sources
+// and reports the client address found in the header as the remote address
+type proxyProtoListener struct {
+	net.Listener
+	trusted []*net.IPNet
+}
+
+func newProxyProtoListener(ln net.Listener, trustedProxies []string) (net.Listener, error) {
+	if len(trustedProxies) == 0 {
+		return ln, nil
+	}
+	trusted := make([]*net.IPNet, 0, len(trustedProxies))
+	for _, cidr := range trustedProxies {
+		block, err := parseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		trusted = append(trusted, block)
+	}
+	return &proxyProtoListener{
+		Listener: ln,
+		trusted:  trusted,
+	}, nil
+}
+
+func (l *proxyProtoListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if !l.isTrusted(conn.RemoteAddr()) {
+		return conn, nil
+	}
+	return &proxyProtoConn{
+		Conn: conn,
+		r:    bufio.NewReader(conn),
+	}, nil
+}
+
+func (l *proxyProtoListener) isTrusted(addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, block := range l.trusted {
+		if block.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// proxyProtoConn reads the PROXY protocol header on first use,
+// so a slow client doesn't block the accept loop
+type proxyProtoConn struct {
+	net.Conn
+	r            *bufio.Reader
+	once         sync.Once
+	remote       net.Addr
+	err          error
+	deadlineMtx  sync.Mutex
+	readDeadline time.Time // set by the user of the connection, restored after the header
+}
+
+func (c *proxyProtoConn) init() {
+	c.once.Do(func() {
+		headerDeadline := time.Now().Add(10 * time.Second)
+		c.deadlineMtx.Lock()
+		if c.readDeadline.IsZero() || c.readDeadline.After(headerDeadline) {
+			c.Conn.SetReadDeadline(headerDeadline)
+		}
+		c.deadlineMtx.Unlock()
+
+		c.remote, c.err = readProxyHeader(c.r)
+
+		c.deadlineMtx.Lock()
+		c.Conn.SetReadDeadline(c.readDeadline)
+		c.deadlineMtx.Unlock()
+		if c.remote == nil {
+			c.remote = c.Conn.RemoteAddr()
+		}
+	})
+}
+
+func (c *proxyProtoConn) Read(b []byte) (int, error) {
+	c.init()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.r.Read(b)
+}
+
+func (c *proxyProtoConn) RemoteAddr() net.Addr {
+	c.init()
+	return c.remote
+}
+
+func (c *proxyProtoConn) SetDeadline(t time.Time) error {
+	c.deadlineMtx.Lock()
+	defer c.deadlineMtx.Unlock()
+	c.readDeadline = t
+	return c.Conn.SetDeadline(t)
+}
+
+func (c *proxyProtoConn) SetReadDeadline(t time.Time) error {
+	c.deadlineMtx.Lock()
+	defer c.deadlineMtx.Unlock()
+	c.readDeadline = t
+	return c.Conn.SetReadDeadline(t)
+}
+
+// readProxyHeader reads a PROXY protocol header if the connection starts with one
+//
+// It returns a nil address if there is no header or the proxy doesn't know the client address.
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	b, err := r.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	switch b[0] {
+	case 'P':
+		if b, err := r.Peek(6); err != nil || string(b) != "PROXY " {
+			return nil, err
+		}
+		return readProxyHeaderV1(r)
+	case '\r':
+		if b, err := r.Peek(len(proxyProtoV2Sig)); err != nil || !bytes.Equal(b, proxyProtoV2Sig) {
+			return nil, err
+		}
+		return readProxyHeaderV2(r)
+	default:
+		return nil, nil
+	}
+}
+
+func readProxyHeaderV1(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= 107 {
+			return nil, fmt.Errorf("PROXY header too long")
+		}
+		c, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, c)
+	}
+
+	fields := strings.Fields(string(line))
+	if len(fields) < 2 {
+		return nil, fmt.Errorf("invalid PROXY header")
+	}
+	switch fields[1] {
+	case "TCP4", "TCP6":
+	case "UNKNOWN":
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("unsupported PROXY protocol: %s", fields[1])
+	}
+	if len(fields) != 6 {
+		return nil, fmt.Errorf("invalid PROXY header")
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil {
+		return nil, fmt.Errorf("invalid PROXY source address")
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+func readProxyHeaderV2(r *bufio.Reader) (net.Addr, error) {
+	var header [16]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	if header[12]>>4 != 2 {
+		return nil, fmt.Errorf("unsupported PROXY protocol version: %d", header[12]>>4)
+	}
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+
+	if header[12]&0xF == 0 { // LOCAL command, e.g. health checks
+		return nil, nil
+	}
+	switch header[13] {
+	case 0x11: // TCP over IPv4
+		if len(payload) < 12 {
+			return nil, fmt.Errorf("invalid PROXY header")
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:4]), Port: int(binary.BigEndian.Uint16(payload[8:]))}, nil
+	case 0x21: // TCP over IPv6
+		if len(payload) < 36 {
+			return nil, fmt.Errorf("invalid PROXY header")
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:16]), Port: int(binary.BigEndian.Uint16(payload[32:]))}, nil
+	default:
+		return nil, nil
+	}
+}
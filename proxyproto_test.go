@@ -0,0 +1,34 @@
+package razproxy
+
+import (
+	"bufio"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestProxyProtoKeepsDeadline(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	conn := &proxyProtoConn{Conn: server, r: bufio.NewReader(server)}
+	defer conn.Close()
+	go client.Write([]byte("PROXY TCP4 192.0.2.1 192.0.2.2 1234 443\r\n"))
+
+	conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	done := make(chan error, 1)
+	go func() {
+		_, err := conn.Read(make([]byte, 1))
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+			t.Fatalf("expected timeout, got %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("the deadline was cleared after the PROXY header")
+	}
+	if addr := conn.RemoteAddr().String(); addr != "192.0.2.1:1234" {
+		t.Fatalf("unexpected remote address: %s", addr)
+	}
+}
@@ -0,0 +1,181 @@
+package razproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+const razproxyALPN = "razproxy"
+
+type quicTunnel struct {
+	numStreams int64
+	conn       *quic.Conn
+}
+
+func quicConfig(conf *TunnelConfig) *quic.Config {
+	quicConf := &quic.Config{
+		HandshakeIdleTimeout: 5 * time.Second,
+		MaxIncomingStreams:   4096,
+	}
+	if conf != nil {
+		quicConf.KeepAlivePeriod = conf.KeepAliveInterval
+		quicConf.MaxIdleTimeout = conf.KeepAliveTimeout
+		if conf.MaxStreamBuffer != 0 {
+			quicConf.MaxStreamReceiveWindow = uint64(conf.MaxStreamBuffer)
+		}
+		if conf.MaxReceiveBuffer != 0 {
+			quicConf.MaxConnectionReceiveWindow = uint64(conf.MaxReceiveBuffer)
+		}
+	}
+	if quicConf.KeepAlivePeriod == 0 {
+		quicConf.KeepAlivePeriod = 10 * time.Second
+	}
+	return quicConf
+}
+
+// dialQUIC connects to a QUIC listener and sends the pre-shared secret (if any)
+// on the first stream
+func dialQUIC(addr string, tlsConf *tls.Config, conf *TunnelConfig, secret string) (tunnel, error) {
+	tlsConf = tlsConf.Clone()
+	tlsConf.MinVersion = tls.VersionTLS13
+	tlsConf.NextProtos = []string{razproxyALPN}
+	conn, err := quic.DialAddr(context.Background(), addr, tlsConf, quicConfig(conf))
+	if err != nil {
+		return nil, err
+	}
+	if len(secret) > 0 {
+		stream, err := conn.OpenStreamSync(context.Background())
+		if err == nil {
+			_, err = stream.Write(secretToken(secret))
+			stream.Close()
+		}
+		if err != nil {
+			conn.CloseWithError(0, "")
+			return nil, err
+		}
+	}
+	return &quicTunnel{conn: conn}, nil
+}
+
+func (t *quicTunnel) OpenStream() (net.Conn, error) {
+	stream, err := t.conn.OpenStreamSync(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	return t.newStream(stream), nil
+}
+
+func (t *quicTunnel) AcceptStream() (net.Conn, error) {
+	stream, err := t.conn.AcceptStream(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	return t.newStream(stream), nil
+}
+
+func (t *quicTunnel) NumStreams() int {
+	return int(atomic.LoadInt64(&t.numStreams))
+}
+
+func (t *quicTunnel) RemoteAddr() net.Addr {
+	return t.conn.RemoteAddr()
+}
+
+func (t *quicTunnel) Close() error {
+	return t.conn.CloseWithError(0, "")
+}
+
+func (t *quicTunnel) newStream(stream *quic.Stream) net.Conn {
+	atomic.AddInt64(&t.numStreams, 1)
+	return &quicStream{Stream: stream, tunnel: t}
+}
+
+type quicStream struct {
+	*quic.Stream
+	tunnel    *quicTunnel
+	closeOnce sync.Once
+}
+
+func (s *quicStream) Close() error {
+	var err error
+	s.closeOnce.Do(func() {
+		s.CancelRead(0)
+		err = s.Stream.Close()
+		atomic.AddInt64(&s.tunnel.numStreams, -1)
+	})
+	return err
+}
+
+func (s *quicStream) LocalAddr() net.Addr {
+	return s.tunnel.conn.LocalAddr()
+}
+
+func (s *quicStream) RemoteAddr() net.Addr {
+	return s.tunnel.conn.RemoteAddr()
+}
+
+// ListenAndServeQUIC starts listening and serving QUIC requests on a given UDP network address
+func (s *Server) ListenAndServeQUIC(address string) error {
+	ln, err := s.listenQUIC(address)
+	if err != nil {
+		return err
+	}
+	return s.serveQUIC(ln)
+}
+
+func (s *Server) listenQUIC(address string) (*quic.Listener, error) {
+	tlsConf := s.serverTLSConfig().Clone()
+	tlsConf.MinVersion = tls.VersionTLS13
+	tlsConf.NextProtos = []string{razproxyALPN}
+	return quic.ListenAddr(address, tlsConf, quicConfig(s.Tunnel))
+}
+
+func (s *Server) serveQUIC(ln *quic.Listener) error {
+	defer ln.Close()
+	s.updateRateLimit()
+
+	for {
+		conn, err := ln.Accept(context.Background())
+		if err != nil {
+			if errors.Is(err, quic.ErrServerClosed) {
+				return net.ErrClosed
+			}
+			return err
+		}
+		if !s.allow(conn.RemoteAddr()) {
+			conn.CloseWithError(0, "")
+			continue
+		}
+		go s.serveQUICConn(conn)
+	}
+}
+
+// serveQUICConn starts a session if the first stream of the connection carries
+// the pre-shared secret (or no secret is set)
+func (s *Server) serveQUICConn(conn *quic.Conn) {
+	if len(s.Secret) > 0 {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		stream, err := conn.AcceptStream(ctx)
+		cancel()
+		if err != nil {
+			conn.CloseWithError(0, "")
+			return
+		}
+		stream.SetReadDeadline(time.Now().Add(10 * time.Second))
+		ok := s.checkSecret(stream)
+		stream.CancelRead(0)
+		stream.Close()
+		if !ok {
+			conn.CloseWithError(0, "")
+			return
+		}
+	}
+	s.newSession(&quicTunnel{conn: conn}).run()
+}
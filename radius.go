@@ -0,0 +1,298 @@
+package razproxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// RADIUS packet codes and attribute types
+const (
+	radiusAccessRequest        = 1
+	radiusAccessAccept         = 2
+	radiusAccessReject         = 3
+	radiusUserName             = 1
+	radiusUserPassword         = 2
+	radiusFilterID             = 11
+	radiusNASIdentifier        = 32
+	radiusMessageAuthenticator = 80
+	radiusMaxAttributeLen      = 253
+)
+
+// RADIUSAuthenticator validates users with PAP Access-Requests sent to a RADIUS server
+//
+// The Filter-Id attribute of Access-Accept responses is used as the policy of
+// the user. Responses have to carry a valid Message-Authenticator. UDP sockets
+// are pooled and successful logins are cached for CacheTTL. Sessions of RADIUS
+// users are not checked again on reload, because that would need their password.
+type RADIUSAuthenticator struct {
+	Addr          string // host:port of the RADIUS server (port 1812 by default)
+	Secret        string
+	NASIdentifier string
+	Timeout       time.Duration // timeout of a single attempt
+	Retries       int
+	PoolSize      int
+	CacheTTL      time.Duration
+	poolOnce      sync.Once
+	pool          chan *radiusConn
+	cache         authCache
+}
+
+type radiusConn struct {
+	net.Conn
+	id uint8
+}
+
+// NewRADIUSAuthenticator returns a new RADIUSAuthenticator with default settings
+func NewRADIUSAuthenticator(addr, secret string) *RADIUSAuthenticator {
+	if _, port, _ := net.SplitHostPort(addr); len(port) == 0 {
+		addr = net.JoinHostPort(addr, "1812")
+	}
+	return &RADIUSAuthenticator{
+		Addr:          addr,
+		Secret:        secret,
+		NASIdentifier: "razproxy",
+		Timeout:       3 * time.Second,
+		Retries:       2,
+		PoolSize:      4,
+		CacheTTL:      5 * time.Minute,
+	}
+}
+
+// Authenticate ...
+func (auth *RADIUSAuthenticator) Authenticate(ctx context.Context, req AuthRequest) (Identity, error) {
+	if req.CredentialType != CredentialPassword {
+		return Identity{}, invalidCredentialsf("unsupported credential type: %s", req.CredentialType)
+	}
+	if len(req.User) == 0 || len(req.User) > radiusMaxAttributeLen || len(req.Password) == 0 || len(req.Password) > 128 {
+		return Identity{}, ErrInvalidCredentials
+	}
+	if id, ok := auth.cache.get(req.User, req.Password); ok {
+		return id, nil
+	}
+	return withContext(ctx, func() (Identity, error) {
+		policy, err := auth.authenticate(req.User, req.Password)
+		if err != nil {
+			return Identity{}, err
+		}
+		id := Identity{User: req.User, Policy: policy}
+		auth.cache.put(req.User, req.Password, id, auth.CacheTTL)
+		return id, nil
+	})
+}
+
+func (auth *RADIUSAuthenticator) authenticate(user, password string) (string, error) {
+	conn, err := auth.get()
+	if err != nil {
+		return "", err
+	}
+	broken := true
+	defer func() {
+		auth.put(conn, broken)
+	}()
+
+	var reqAuth [16]byte
+	if _, err := rand.Read(reqAuth[:]); err != nil {
+		return "", err
+	}
+	conn.id++
+	req, err := auth.accessRequest(conn.id, reqAuth, user, password)
+	if err != nil {
+		broken = false
+		return "", err
+	}
+
+	// responses that fail the checks are ignored, so stray packets can't fail a login
+	var invalidErr error
+	buf := make([]byte, 4096)
+	for attempt := 0; attempt <= auth.Retries; attempt++ {
+		if _, err := conn.Write(req); err != nil {
+			return "", err
+		}
+		conn.SetReadDeadline(time.Now().Add(auth.Timeout))
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				if ne, ok := err.(net.Error); ok && ne.Timeout() {
+					break // retry
+				}
+				return "", err
+			}
+			resp := buf[:n]
+			if len(resp) < 20 || resp[1] != conn.id || int(binary.BigEndian.Uint16(resp[2:4])) != n {
+				continue // late response to an earlier request or garbage
+			}
+			if !auth.validResponse(resp, reqAuth) {
+				invalidErr = fmt.Errorf("invalid response authenticator")
+				continue
+			}
+			if !auth.validMessageAuthenticator(resp, reqAuth) {
+				invalidErr = fmt.Errorf("missing or invalid Message-Authenticator")
+				continue
+			}
+			broken = false
+			switch resp[0] {
+			case radiusAccessAccept:
+				return string(radiusAttribute(resp[20:], radiusFilterID)), nil
+			case radiusAccessReject:
+				return "", ErrInvalidCredentials
+			default:
+				return "", fmt.Errorf("unsupported response code: %d", resp[0])
+			}
+		}
+	}
+	if invalidErr != nil {
+		return "", invalidErr
+	}
+	return "", fmt.Errorf("RADIUS server timeout")
+}
+
+// accessRequest builds an Access-Request packet with a PAP password and a Message-Authenticator
+func (auth *RADIUSAuthenticator) accessRequest(id uint8, reqAuth [16]byte, user, password string) ([]byte, error) {
+	var attrs bytes.Buffer
+	for _, attr := range []struct {
+		typ   byte
+		value []byte
+	}{
+		{radiusUserName, []byte(user)},
+		{radiusUserPassword, auth.hidePassword(password, reqAuth)},
+		{radiusNASIdentifier, []byte(auth.NASIdentifier)},
+	} {
+		if err := writeRadiusAttribute(&attrs, attr.typ, attr.value); err != nil {
+			return nil, err
+		}
+	}
+	msgAuthOffset := 20 + attrs.Len() + 2
+	writeRadiusAttribute(&attrs, radiusMessageAuthenticator, make([]byte, 16))
+
+	packet := make([]byte, 20, 20+attrs.Len())
+	packet[0] = radiusAccessRequest
+	packet[1] = id
+	binary.BigEndian.PutUint16(packet[2:4], uint16(20+attrs.Len()))
+	copy(packet[4:20], reqAuth[:])
+	packet = append(packet, attrs.Bytes()...)
+
+	mac := hmac.New(md5.New, []byte(auth.Secret))
+	mac.Write(packet)
+	copy(packet[msgAuthOffset:], mac.Sum(nil))
+	return packet, nil
+}
+
+// hidePassword encrypts the password as described in RFC 2865 section 5.2
+func (auth *RADIUSAuthenticator) hidePassword(password string, reqAuth [16]byte) []byte {
+	padded := make([]byte, (len(password)+15)/16*16)
+	copy(padded, password)
+	prev := reqAuth[:]
+	for i := 0; i < len(padded); i += 16 {
+		b := md5.Sum(append([]byte(auth.Secret), prev...))
+		for j := 0; j < 16; j++ {
+			padded[i+j] ^= b[j]
+		}
+		prev = padded[i : i+16]
+	}
+	return padded
+}
+
+// validResponse checks the response authenticator of a reply
+func (auth *RADIUSAuthenticator) validResponse(resp []byte, reqAuth [16]byte) bool {
+	h := md5.New()
+	h.Write(resp[:4])
+	h.Write(reqAuth[:])
+	h.Write(resp[20:])
+	h.Write([]byte(auth.Secret))
+	return hmac.Equal(h.Sum(nil), resp[4:20])
+}
+
+// validMessageAuthenticator checks the Message-Authenticator of a reply, which is
+// required so responses can't be forged (BlastRADIUS, CVE-2024-3596)
+func (auth *RADIUSAuthenticator) validMessageAuthenticator(resp []byte, reqAuth [16]byte) bool {
+	packet := append([]byte(nil), resp...)
+	copy(packet[4:20], reqAuth[:])
+	msgAuth := radiusAttribute(packet[20:], radiusMessageAuthenticator)
+	if len(msgAuth) != 16 {
+		return false
+	}
+	expected := append([]byte(nil), msgAuth...)
+	for i := range msgAuth {
+		msgAuth[i] = 0 // the attribute is zeroed in packet, which it points into
+	}
+	mac := hmac.New(md5.New, []byte(auth.Secret))
+	mac.Write(packet)
+	return hmac.Equal(mac.Sum(nil), expected)
+}
+
+// writeRadiusAttribute appends an attribute, whose value can be at most 253 bytes long
+func writeRadiusAttribute(buf *bytes.Buffer, typ byte, value []byte) error {
+	if len(value) > radiusMaxAttributeLen {
+		return fmt.Errorf("RADIUS attribute %d is too long: %d bytes", typ, len(value))
+	}
+	buf.WriteByte(typ)
+	buf.WriteByte(byte(len(value) + 2))
+	buf.Write(value)
+	return nil
+}
+
+// radiusAttribute returns the value of the first attribute of the given type
+func radiusAttribute(attrs []byte, typ byte) []byte {
+	for len(attrs) >= 2 {
+		length := int(attrs[1])
+		if length < 2 || length > len(attrs) {
+			return nil
+		}
+		if attrs[0] == typ {
+			return attrs[2:length]
+		}
+		attrs = attrs[length:]
+	}
+	return nil
+}
+
+// Close closes the pooled connections
+func (auth *RADIUSAuthenticator) Close() error {
+	auth.poolOnce.Do(func() {
+		auth.pool = make(chan *radiusConn, auth.PoolSize)
+	})
+	for {
+		select {
+		case conn := <-auth.pool:
+			conn.Close()
+		default:
+			return nil
+		}
+	}
+}
+
+func (auth *RADIUSAuthenticator) get() (*radiusConn, error) {
+	auth.poolOnce.Do(func() {
+		auth.pool = make(chan *radiusConn, auth.PoolSize)
+	})
+	select {
+	case conn := <-auth.pool:
+		return conn, nil
+	default:
+		conn, err := net.DialTimeout("udp", auth.Addr, auth.Timeout)
+		if err != nil {
+			return nil, err
+		}
+		return &radiusConn{Conn: conn}, nil
+	}
+}
+
+func (auth *RADIUSAuthenticator) put(conn *radiusConn, broken bool) {
+	if broken {
+		conn.Close()
+		return
+	}
+	select {
+	case auth.pool <- conn:
+	default:
+		conn.Close()
+	}
+}
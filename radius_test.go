@@ -0,0 +1,252 @@
+package razproxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"encoding/binary"
+	"errors"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const testRadiusSecret = "radius-secret"
+
+// testRadiusServer answers the Access-Requests of the users as a RADIUS server would
+type testRadiusServer struct {
+	conn      net.PacketConn
+	users     map[string]string // password per user
+	policies  map[string]string // Filter-Id per user
+	drop      int32             // number of requests to ignore
+	badAuth   bool              // send a wrong response authenticator
+	noMsgAuth bool              // leave out the Message-Authenticator
+	stray     bool              // send a forged response before the real one
+	requests  int32
+}
+
+func newTestRadiusServer(t *testing.T, configure func(srv *testRadiusServer)) *testRadiusServer {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	srv := &testRadiusServer{
+		conn:     conn,
+		users:    map[string]string{"alice": "alice-pw", "bob": "a password longer than 16 bytes"},
+		policies: map[string]string{"alice": "staff"},
+	}
+	if configure != nil {
+		configure(srv)
+	}
+	go srv.serve(t)
+	return srv
+}
+
+func (srv *testRadiusServer) authenticator(t *testing.T) *RADIUSAuthenticator {
+	auth := NewRADIUSAuthenticator(srv.conn.LocalAddr().String(), testRadiusSecret)
+	auth.Timeout = 100 * time.Millisecond
+	auth.CacheTTL = 0
+	t.Cleanup(func() { auth.Close() })
+	return auth
+}
+
+func (srv *testRadiusServer) serve(t *testing.T) {
+	buf := make([]byte, 4096)
+	for {
+		n, addr, err := srv.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		atomic.AddInt32(&srv.requests, 1)
+		if atomic.AddInt32(&srv.drop, -1) >= 0 {
+			continue
+		}
+		req := buf[:n]
+		if !validRequestMessageAuthenticator(req) {
+			t.Error("invalid Message-Authenticator in request")
+			continue
+		}
+		var reqAuth [16]byte
+		copy(reqAuth[:], req[4:20])
+		user := string(radiusAttribute(req[20:], radiusUserName))
+		password := revealPassword(radiusAttribute(req[20:], radiusUserPassword), reqAuth)
+
+		code := byte(radiusAccessReject)
+		var attrs bytes.Buffer
+		if pw, ok := srv.users[user]; ok && pw == password {
+			code = radiusAccessAccept
+			if policy := srv.policies[user]; len(policy) > 0 {
+				writeRadiusAttribute(&attrs, radiusFilterID, []byte(policy))
+			}
+		}
+		resp := srv.response(code, req[1], reqAuth, attrs.Bytes())
+		if srv.stray {
+			forged := append([]byte(nil), resp...)
+			forged[0] = radiusAccessReject
+			srv.conn.WriteTo(forged, addr)
+		}
+		srv.conn.WriteTo(resp, addr)
+	}
+}
+
+// response builds a reply with a Message-Authenticator and response authenticator as in RFC 2865 and 3579
+func (srv *testRadiusServer) response(code, id byte, reqAuth [16]byte, attrs []byte) []byte {
+	var buf bytes.Buffer
+	buf.Write(attrs)
+	msgAuthOffset := 20 + buf.Len() + 2
+	if !srv.noMsgAuth {
+		writeRadiusAttribute(&buf, radiusMessageAuthenticator, make([]byte, 16))
+	}
+
+	packet := make([]byte, 20, 20+buf.Len())
+	packet[0] = code
+	packet[1] = id
+	binary.BigEndian.PutUint16(packet[2:4], uint16(20+buf.Len()))
+	copy(packet[4:20], reqAuth[:])
+	packet = append(packet, buf.Bytes()...)
+
+	if !srv.noMsgAuth {
+		mac := hmac.New(md5.New, []byte(testRadiusSecret))
+		mac.Write(packet)
+		copy(packet[msgAuthOffset:], mac.Sum(nil))
+	}
+	sum := md5.Sum(append(packet, testRadiusSecret...))
+	copy(packet[4:20], sum[:])
+	if srv.badAuth {
+		packet[4] ^= 0xff
+	}
+	return packet
+}
+
+func validRequestMessageAuthenticator(req []byte) bool {
+	packet := append([]byte(nil), req...)
+	msgAuth := radiusAttribute(packet[20:], radiusMessageAuthenticator)
+	if len(msgAuth) != 16 {
+		return false
+	}
+	expected := append([]byte(nil), msgAuth...)
+	for i := range msgAuth {
+		msgAuth[i] = 0
+	}
+	mac := hmac.New(md5.New, []byte(testRadiusSecret))
+	mac.Write(packet)
+	return hmac.Equal(mac.Sum(nil), expected)
+}
+
+func revealPassword(hidden []byte, reqAuth [16]byte) string {
+	password := make([]byte, len(hidden))
+	prev := reqAuth[:]
+	for i := 0; i+16 <= len(hidden); i += 16 {
+		b := md5.Sum(append([]byte(testRadiusSecret), prev...))
+		for j := 0; j < 16; j++ {
+			password[i+j] = hidden[i+j] ^ b[j]
+		}
+		prev = hidden[i : i+16]
+	}
+	return strings.TrimRight(string(password), "\x00")
+}
+
+func TestRADIUSAuthenticator(t *testing.T) {
+	srv := newTestRadiusServer(t, nil)
+	auth := srv.authenticator(t)
+
+	id, err := auth.Authenticate(context.Background(), AuthRequest{User: "alice", Password: "alice-pw"})
+	if err != nil || id.User != "alice" || id.Policy != "staff" {
+		t.Fatalf("expected alice with staff policy, got %+v, %v", id, err)
+	}
+	id, err = auth.Authenticate(context.Background(), AuthRequest{User: "bob", Password: "a password longer than 16 bytes"})
+	if err != nil || id.User != "bob" || id.Policy != "" {
+		t.Fatalf("expected bob without policy, got %+v, %v", id, err)
+	}
+	if _, err := auth.Authenticate(context.Background(), AuthRequest{User: "alice", Password: "wrong"}); !errors.Is(err, ErrInvalidCredentials) {
+		t.Fatalf("expected invalid credentials, got %v", err)
+	}
+}
+
+func TestRADIUSAuthenticatorForgedResponse(t *testing.T) {
+	tests := []struct {
+		name string
+		set  func(srv *testRadiusServer)
+	}{
+		{name: "bad response authenticator", set: func(srv *testRadiusServer) { srv.badAuth = true }},
+		{name: "no Message-Authenticator", set: func(srv *testRadiusServer) { srv.noMsgAuth = true }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := newTestRadiusServer(t, tt.set)
+			auth := srv.authenticator(t)
+			_, err := auth.Authenticate(context.Background(), AuthRequest{User: "alice", Password: "alice-pw"})
+			if err == nil || errors.Is(err, ErrInvalidCredentials) {
+				t.Fatalf("expected backend error, got %v", err)
+			}
+		})
+	}
+}
+
+func TestRADIUSAuthenticatorStrayResponse(t *testing.T) {
+	srv := newTestRadiusServer(t, func(srv *testRadiusServer) { srv.stray = true })
+	auth := srv.authenticator(t)
+
+	// the forged reject is ignored, and the real response is read within the same attempt
+	if _, err := auth.Authenticate(context.Background(), AuthRequest{User: "alice", Password: "alice-pw"}); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&srv.requests); n != 1 {
+		t.Fatalf("expected 1 request, got %d", n)
+	}
+}
+
+func TestRADIUSAuthenticatorLongUser(t *testing.T) {
+	srv := newTestRadiusServer(t, nil)
+	auth := srv.authenticator(t)
+
+	user := strings.Repeat("a", 254)
+	if _, err := auth.Authenticate(context.Background(), AuthRequest{User: user, Password: "alice-pw"}); !errors.Is(err, ErrInvalidCredentials) {
+		t.Fatalf("expected invalid credentials, got %v", err)
+	}
+	if n := atomic.LoadInt32(&srv.requests); n != 0 {
+		t.Fatalf("expected no requests, got %d", n)
+	}
+	if err := writeRadiusAttribute(new(bytes.Buffer), radiusUserName, []byte(user)); err == nil {
+		t.Fatal("attribute that doesn't fit was written")
+	}
+}
+
+func TestRADIUSAuthenticatorRetry(t *testing.T) {
+	srv := newTestRadiusServer(t, func(srv *testRadiusServer) { srv.drop = 2 })
+	auth := srv.authenticator(t)
+	auth.Retries = 2
+
+	if _, err := auth.Authenticate(context.Background(), AuthRequest{User: "alice", Password: "alice-pw"}); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&srv.requests); n != 3 {
+		t.Fatalf("expected 3 requests, got %d", n)
+	}
+}
+
+func TestRADIUSAuthenticatorTimeout(t *testing.T) {
+	srv := newTestRadiusServer(t, func(srv *testRadiusServer) { srv.drop = 1000 })
+	auth := srv.authenticator(t)
+	auth.Retries = 1
+
+	_, err := auth.Authenticate(context.Background(), AuthRequest{User: "alice", Password: "alice-pw"})
+	if err == nil || errors.Is(err, ErrInvalidCredentials) {
+		t.Fatalf("expected timeout, got %v", err)
+	}
+	if n := atomic.LoadInt32(&srv.requests); n != 2 {
+		t.Fatalf("expected 2 requests, got %d", n)
+	}
+
+	// the context ends the attempts early
+	auth.Retries = 100
+	ctx, cancel := context.WithTimeout(context.Background(), 150*time.Millisecond)
+	defer cancel()
+	if _, err := auth.Authenticate(ctx, AuthRequest{User: "alice", Password: "alice-pw"}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected deadline exceeded, got %v", err)
+	}
+}
@@ -35,3 +35,26 @@ func (r *rateLimiter) get(ip string) *rate.Limiter {
 
 	return limiter
 }
+
+// set changes the limit of new and existing limiters
+func (r *rateLimiter) set(limit rate.Limit, burst int) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.r = limit
+	r.b = burst
+	for _, limiter := range r.ips {
+		limiter.SetLimit(limit)
+		limiter.SetBurst(burst)
+	}
+}
+
+// tokens returns the number of available tokens per IP
+func (r *rateLimiter) tokens() map[string]float64 {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+	tokens := make(map[string]float64, len(r.ips))
+	for ip, limiter := range r.ips {
+		tokens[ip] = limiter.Tokens()
+	}
+	return tokens
+}
@@ -0,0 +1,152 @@
+package razproxy
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync/atomic"
+	"time"
+
+	"github.com/armon/go-socks5"
+)
+
+// ErrNoServer is returned when no upstream server becomes available in time
+var ErrNoServer = fmt.Errorf("no server available")
+
+// ConnState is the connection state of an upstream server
+type ConnState int32
+
+// Connection states
+const (
+	StateConnected ConnState = iota
+	StateDisconnected
+	StateReconnecting
+	StateFailed
+)
+
+func (s ConnState) String() string {
+	switch s {
+	case StateConnected:
+		return "connected"
+	case StateDisconnected:
+		return "disconnected"
+	case StateReconnecting:
+		return "reconnecting"
+	case StateFailed:
+		return "failed"
+	default:
+		return fmt.Sprintf("ConnState(%d)", int32(s))
+	}
+}
+
+// ClientEvent describes a connection state change of an upstream server
+type ClientEvent struct {
+	Server  string
+	State   ConnState
+	Attempt int
+	Err     error
+}
+
+func (u *upstream) getState() ConnState {
+	return ConnState(atomic.LoadInt32(&u.state))
+}
+
+func (u *upstream) setState(state ConnState, attempt int, err error) {
+	atomic.StoreInt32(&u.state, int32(state))
+	u.client.stateChanged(ClientEvent{
+		Server:  u.Addr,
+		State:   state,
+		Attempt: attempt,
+		Err:     err,
+	})
+}
+
+// reconnect tries to connect to the server with jittered exponential backoff
+// until it succeeds, authentication fails or the maximum number of attempts is reached
+func (u *upstream) reconnect() {
+	conf := u.client.conf
+	delay := conf.ReconnectMinDelay
+	for attempt := 1; conf.ReconnectMaxAttempts <= 0 || attempt <= conf.ReconnectMaxAttempts; attempt++ {
+		u.setState(StateReconnecting, attempt, nil)
+		time.Sleep(jitter(delay))
+
+		err := u.connect()
+		if err == nil {
+			return
+		}
+		if errors.Is(err, ErrAuthFailed) {
+			u.setState(StateFailed, attempt, err)
+			return
+		}
+		u.client.Logger.Println(u.Addr+":", err)
+
+		delay *= 2
+		if delay > conf.ReconnectMaxDelay {
+			delay = conf.ReconnectMaxDelay
+		}
+	}
+	u.setState(StateFailed, conf.ReconnectMaxAttempts, fmt.Errorf("giving up after %d attempts", conf.ReconnectMaxAttempts))
+}
+
+// jitter returns a random duration between d/2 and d
+func jitter(d time.Duration) time.Duration {
+	if d <= 1 {
+		return d
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+func (c *Client) stateChanged(event ClientEvent) {
+	switch {
+	case event.Err != nil:
+		c.Logger.Println(event.Server, event.State.String()+":", event.Err)
+	case event.State == StateDisconnected:
+		c.Logger.Println("disconnected from", event.Server)
+	case event.State == StateReconnecting:
+		c.Logger.Printf("reconnecting to %s.. (attempt %d)", event.Server, event.Attempt)
+	}
+
+	c.stateMtx.Lock()
+	close(c.stateCh)
+	c.stateCh = make(chan struct{})
+	c.stateMtx.Unlock()
+
+	if c.conf.OnEvent != nil {
+		c.conf.OnEvent(event)
+	}
+}
+
+// waitUpstreams returns the upstreams to try for dest and waits for one to
+// become available until the deadline if necessary
+func (c *Client) waitUpstreams(dest *socks5.AddrSpec, deadline time.Time) ([]*upstream, error) {
+	timeout := time.NewTimer(time.Until(deadline))
+	defer timeout.Stop()
+
+	for {
+		c.stateMtx.Lock()
+		changed := c.stateCh
+		c.stateMtx.Unlock()
+
+		if upstreams := c.pick(dest); len(upstreams) > 0 {
+			return upstreams, nil
+		}
+		if c.allFailed() {
+			return nil, ErrNoServer
+		}
+
+		select {
+		case <-changed:
+		case <-timeout.C:
+			return nil, ErrNoServer
+		}
+	}
+}
+
+func (c *Client) allFailed() bool {
+	for _, u := range c.upstreams {
+		if u.getState() != StateFailed {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,135 @@
+package razproxy
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+)
+
+// Reload changes the settings of the running server without dropping the sessions
+//
+// update is called while the settings are locked, so it may change the exported
+// fields of the server. Sessions see either the old or the new settings. auth
+// replaces the authenticator unless it is nil. Listeners, certificates and
+// outbounds that are already in use are not affected.
+//
+// The sessions are checked against the new authenticator afterwards, with the
+// identities it returned at login (see IdentityChecker). Sessions of users who
+// are rejected stop accepting new streams and reverse connections, but keep
+// their open streams unless terminate is true, which closes them (and the ones
+// revoked earlier) right away. Sessions are kept if the authenticator cannot
+// check identities or fails with a backend error, or if their token expired
+// since login (ErrTokenExpired).
+func (s *Server) Reload(auth ContextAuthenticator, update func(s *Server), terminate bool) {
+	s.settingsMtx.Lock()
+	if auth != nil {
+		s.auth = auth
+	}
+	if update != nil {
+		update(s)
+	}
+	s.settingsMtx.Unlock()
+	s.updateRateLimit()
+
+	s.updateBandwidth()
+
+	s.sessionsMtx.Lock()
+	sessions := make([]*serverSession, 0, len(s.sessions))
+	for session := range s.sessions {
+		sessions = append(sessions, session)
+	}
+	s.sessionsMtx.Unlock()
+
+	// the token checks share the timeout, so an unavailable IdP doesn't block the reload for long
+	ctx, cancel := context.WithTimeout(context.Background(), s.authTimeout())
+	defer cancel()
+	for _, session := range sessions {
+		session.flushDNSCache()
+		session.identityMtx.RLock()
+		credentials, authenticated, revoked := session.credentials, session.authenticated, session.revoked
+		session.identityMtx.RUnlock()
+		if revoked && terminate {
+			session.log("no longer authorized - closing session")
+			session.session.Close()
+		}
+		if !authenticated {
+			continue
+		}
+		id, err := s.checkSessionCredentials(ctx, &credentials)
+		if err == nil {
+			session.identityMtx.Lock()
+			session.policy = id.Policy
+			session.credentials.identity = id
+			session.identityMtx.Unlock()
+			continue
+		}
+		if err == errUncheckedIdentity || errors.Is(err, ErrTokenExpired) {
+			continue // the authenticator cannot tell, and tokens only have to be valid at login
+		}
+		if !errors.Is(err, ErrInvalidCredentials) {
+			session.log("cannot check authorization (", err, ") - keeping session")
+			continue
+		}
+		session.revoke()
+		if terminate {
+			session.log("no longer authorized - closing session")
+			session.session.Close()
+		} else {
+			session.log("no longer authorized - not accepting new streams")
+		}
+	}
+	s.Logger.Println("settings reloaded")
+}
+
+// sessionCredentials is what sessions keep of the credentials of their client,
+// so they can be checked again on reload
+//
+// Passwords are only kept as a salted hash, and the identity returned by the
+// authenticator is checked instead of asking its backend again. Token
+// credentials are kept as they are, because they are validated locally.
+type sessionCredentials struct {
+	identity       Identity
+	credentialType string
+	credential     string
+	salt           []byte
+	passwordHash   []byte
+}
+
+func newSessionCredentials(req *AuthRequest, id Identity) sessionCredentials {
+	c := sessionCredentials{
+		identity:       id,
+		credentialType: req.CredentialType,
+	}
+	if req.CredentialType != CredentialPassword {
+		c.credential = req.Credential
+		return c
+	}
+	c.salt = make([]byte, 16)
+	rand.Read(c.salt)
+	c.passwordHash = c.hash(req.Password)
+	return c
+}
+
+func (c *sessionCredentials) hash(password string) []byte {
+	mac := hmac.New(sha256.New, c.salt)
+	mac.Write([]byte(password))
+	return mac.Sum(nil)
+}
+
+// password reports whether password is the one the client logged in with
+func (c *sessionCredentials) password(password string) bool {
+	return c.passwordHash != nil && hmac.Equal(c.hash(password), c.passwordHash)
+}
+
+// checkSessionCredentials checks the credentials of a session against the current settings
+func (s *Server) checkSessionCredentials(ctx context.Context, c *sessionCredentials) (Identity, error) {
+	if c.credentialType != CredentialPassword {
+		return s.checkCredentials(ctx, &AuthRequest{CredentialType: c.credentialType, Credential: c.credential})
+	}
+	s.settingsMtx.RLock()
+	auth := s.auth
+	s.settingsMtx.RUnlock()
+	return checkIdentity(auth, c.identity, c.password)
+}
@@ -0,0 +1,128 @@
+package razproxy
+
+import (
+	"net"
+	"testing"
+
+	"github.com/armon/go-socks5"
+)
+
+func TestReloadRevokesSession(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	dest := &socks5.AddrSpec{IP: net.IPv4(127, 0, 0, 1), Port: ln.Addr().(*net.TCPAddr).Port}
+
+	srv := newTestServer(t)
+	srv.LAN = true
+	u := newTestUpstream(serveTest(srv))
+	session, err := u.newSession("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+	conn, err := session.dial(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	// the session keeps running, but doesn't accept new streams
+	srv.Reload(BasicAuthenticator{"bob": "bob-pw"}, nil, false)
+	if _, err := session.dial(dest); err != SocksError(ruleFailure) {
+		t.Fatal("revoked session accepted a new stream:", err)
+	}
+	if _, err := session.ping(pingTestTimeout); err != nil {
+		t.Fatal("revoked session was closed:", err)
+	}
+
+	// terminating reloads close the sessions revoked earlier, too
+	srv.Reload(nil, nil, true)
+	if _, err := session.ping(pingTestTimeout); err == nil {
+		t.Fatal("revoked session was not closed")
+	}
+}
+
+func TestReloadChecksIdentities(t *testing.T) {
+	newLDAP := func() *LDAPAuthenticator {
+		auth := NewLDAPAuthenticator("ldap://127.0.0.1:1", "dc=example") // never queried
+		auth.GroupPolicies = []GroupPolicy{{Group: "vpn", Policy: "vpn"}}
+		return auth
+	}
+	erin := Identity{User: "erin", Groups: []string{"cn=vpn,ou=groups,dc=example"}, Attributes: map[string]string{"dn": "uid=erin,dc=example"}}
+
+	tests := []struct {
+		name          string
+		auth          ContextAuthenticator
+		id            Identity
+		password      string
+		newAuth       func() ContextAuthenticator
+		authenticated bool
+		policy        string
+	}{
+		{
+			name: "same password", auth: BasicAuthenticator{"alice": "alice-pw"},
+			id: Identity{User: "alice"}, password: "alice-pw",
+			newAuth:       func() ContextAuthenticator { return BasicAuthenticator{"alice": "alice-pw", "bob": "bob-pw"} },
+			authenticated: true,
+		},
+		{
+			name: "changed password", auth: BasicAuthenticator{"alice": "alice-pw"},
+			id: Identity{User: "alice"}, password: "alice-pw",
+			newAuth: func() ContextAuthenticator { return BasicAuthenticator{"alice": "new-pw"} },
+		},
+		{
+			name: "new policy of groups", auth: newLDAP(), id: erin, password: "erin-pw",
+			newAuth: func() ContextAuthenticator {
+				auth := newLDAP()
+				auth.GroupPolicies = []GroupPolicy{{Group: "vpn", Policy: "restricted"}}
+				return auth
+			},
+			authenticated: true, policy: "restricted",
+		},
+		{
+			name: "required groups", auth: newLDAP(), id: erin, password: "erin-pw",
+			newAuth: func() ContextAuthenticator {
+				auth := newLDAP()
+				auth.RequiredGroups = []string{"admins"}
+				return auth
+			},
+		},
+		{
+			name: "removed from chain", auth: BasicAuthenticator{"alice": "alice-pw"},
+			id: Identity{User: "alice"}, password: "alice-pw",
+			newAuth: func() ContextAuthenticator { return ChainAuthenticator{BasicAuthenticator{}, newLDAP()} },
+		},
+		{
+			name: "unchecked", auth: BasicAuthenticator{"alice": "alice-pw"},
+			id: Identity{User: "alice"}, password: "alice-pw",
+			newAuth:       func() ContextAuthenticator { return NewRADIUSAuthenticator("127.0.0.1:1", "secret") },
+			authenticated: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := newTestServer(t)
+			session := srv.newSession(nil)
+			session.setIdentity(session.id, tt.id, newSessionCredentials(&AuthRequest{User: tt.id.User, Password: tt.password}, tt.id))
+			srv.addSession(session)
+
+			srv.Reload(tt.newAuth(), nil, false)
+			_, policy, authenticated := session.identity()
+			if authenticated != tt.authenticated || policy != tt.policy {
+				t.Fatalf("expected authenticated=%v with policy %q, got %v with %q", tt.authenticated, tt.policy, authenticated, policy)
+			}
+		})
+	}
+}
@@ -0,0 +1,192 @@
+package razproxy
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// ReverseForward exposes a service of the client through the server
+type ReverseForward struct {
+	Remote string // address the server listens on, e.g. :8080
+	Local  string // address of the service the client connects to, e.g. localhost:3000
+}
+
+// ReverseRule allows users to listen on a range of ports on the server
+type ReverseRule struct {
+	User    string // empty or * means any user
+	Host    string // empty means any bind address
+	MinPort int
+	MaxPort int
+}
+
+// ParseReverseRule parses a rule in the form of [user@][host:]port[-port]
+func ParseReverseRule(s string) (ReverseRule, error) {
+	var rule ReverseRule
+	if i := strings.LastIndex(s, "@"); i >= 0 {
+		rule.User, s = s[:i], s[i+1:]
+	}
+	if i := strings.LastIndex(s, ":"); i >= 0 {
+		rule.Host, s = strings.Trim(s[:i], "[]"), s[i+1:]
+	}
+	minPort, maxPort, err := parsePortRange(s)
+	if err != nil {
+		return rule, err
+	}
+	rule.MinPort, rule.MaxPort = minPort, maxPort
+	return rule, nil
+}
+
+func (r *ReverseRule) allows(user, host string, port int) bool {
+	if len(r.User) > 0 && r.User != "*" && r.User != user {
+		return false
+	}
+	if len(r.Host) > 0 && r.Host != host {
+		return false
+	}
+	return port >= r.MinPort && port <= r.MaxPort
+}
+
+// allowReverse checks if the user is allowed to listen on the given address
+func (s *Server) allowReverse(user, addr string) bool {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return false
+	}
+	s.settingsMtx.RLock()
+	defer s.settingsMtx.RUnlock()
+	for _, rule := range s.ReverseRules {
+		if rule.allows(user, host, port) {
+			return true
+		}
+	}
+	return false
+}
+
+// reverse starts listening on addr and forwards the incoming connections to the client
+func (s *serverSession) reverse(addr string) (uint32, string, error) {
+	user, _, authenticated := s.identity()
+	if !authenticated {
+		return 0, "", &ControlError{Code: ErrCodeUnauthenticated, Message: "not authenticated"}
+	}
+	if !s.srv.allowReverse(user, addr) {
+		s.log("reverse tunnel not allowed: ", addr)
+		return 0, "", &ControlError{Code: ErrCodeForbidden, Message: "reverse tunnel not allowed: " + addr}
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return 0, "", err
+	}
+
+	id := atomic.AddUint32(&s.reverseSeq, 1)
+	s.reverseMtx.Lock()
+	if s.reverseClosed { // the session closed while listening
+		s.reverseMtx.Unlock()
+		ln.Close()
+		return 0, "", errors.New("session closed")
+	}
+	s.reverseListeners = append(s.reverseListeners, ln)
+	s.reverseMtx.Unlock()
+	s.log("reverse tunnel listening on ", ln.Addr())
+	go s.serveReverse(id, ln)
+	return id, ln.Addr().String(), nil
+}
+
+func (s *serverSession) serveReverse(id uint32, ln net.Listener) {
+	defer ln.Close()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			stream, err := s.session.OpenStream()
+			if err != nil {
+				s.log("stream error: ", err)
+				return
+			}
+			defer stream.Close()
+
+			var header [4]byte
+			binary.BigEndian.PutUint32(header[:], id)
+			if _, err := stream.Write(header[:]); err != nil {
+				return
+			}
+			go s.filterLog("REVERSE: ", conn.RemoteAddr().String(), " -> ", ln.Addr().String())
+			relay(conn, stream)
+		}()
+	}
+}
+
+func (s *serverSession) closeReverse() {
+	s.reverseMtx.Lock()
+	defer s.reverseMtx.Unlock()
+	for _, ln := range s.reverseListeners {
+		ln.Close()
+	}
+	s.reverseListeners = nil
+	s.reverseClosed = true
+}
+
+// startReverse asks the server to listen on the configured addresses
+// and serves the streams the server opens for incoming connections
+func (u *upstream) startReverse(session *clientSession) {
+	forwards := u.client.conf.Reverse
+	if len(forwards) == 0 {
+		return
+	}
+	if !session.control.has(FeatureReverse) {
+		u.client.Logger.Println(u.Addr, "does not support reverse tunnels")
+		return
+	}
+
+	targets := make(map[uint32]string)
+	for _, f := range forwards {
+		res := new(ReverseResult)
+		if err := session.control.call("reverse", &ReverseRequest{Addr: f.Remote}, res); err != nil {
+			u.client.Logger.Println("reverse tunnel error on", u.Addr+":", err)
+			continue
+		}
+		u.client.Logger.Println(u.Addr, "forwards", res.Addr, "to", f.Local)
+		targets[res.ID] = f.Local
+	}
+
+	for {
+		stream, err := session.session.AcceptStream()
+		if err != nil {
+			return
+		}
+		go u.client.serveReverse(stream, targets)
+	}
+}
+
+func (c *Client) serveReverse(stream net.Conn, targets map[uint32]string) {
+	defer stream.Close()
+
+	var header [4]byte
+	if _, err := io.ReadFull(stream, header[:]); err != nil {
+		return
+	}
+	target, ok := targets[binary.BigEndian.Uint32(header[:])]
+	if !ok {
+		return
+	}
+
+	conn, err := net.DialTimeout("tcp", target, 10*time.Second)
+	if err != nil {
+		c.Logger.Println("reverse tunnel error:", err)
+		return
+	}
+	defer conn.Close()
+	relay(stream, conn)
+}
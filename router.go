@@ -0,0 +1,430 @@
+package razproxy
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/armon/go-socks5"
+	"github.com/fsnotify/fsnotify"
+)
+
+// Action tells the client what to do with a request
+type Action string
+
+// Built-in actions
+const (
+	ActionProxy  Action = "proxy"
+	ActionDirect Action = "direct"
+	ActionReject Action = "reject"
+)
+
+type routeRule struct {
+	match  func(t *routeTarget) bool
+	action Action
+}
+
+type routeTable struct {
+	rules   []routeRule
+	def     Action
+	resolve bool
+	files   []string
+}
+
+// Router decides which action to take for a destination address
+type Router struct {
+	file   string
+	table  atomic.Value // *routeTable
+	logger *log.Logger
+}
+
+// NewRouter returns a Router that applies the same action to every destination
+func NewRouter(def Action) *Router {
+	r := &Router{}
+	r.table.Store(&routeTable{def: def})
+	return r
+}
+
+// LoadRouter returns a Router that reads its rules from a file and watches it for updates
+//
+// Each non-empty line of the file is a rule in the form of '<type> [value] <action>'
+// where type is one of domain, domain-suffix, domain-regex, cidr, port, list, plain or private.
+// List files contain one domain suffix or CIDR per line (like GeoIP lists).
+// The first matching rule wins. The 'default <action>' line sets the action used
+// when no rule matches, and the 'resolve' line enables local DNS resolution for CIDR rules.
+func LoadRouter(file string, logger *log.Logger) (*Router, error) {
+	r := &Router{
+		file:   file,
+		logger: logger,
+	}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	go r.watch()
+	return r, nil
+}
+
+// Route returns the action for the given destination
+//
+// If resolution is enabled, the CIDR rules resolve domains with the system resolver.
+func (r *Router) Route(dest *socks5.AddrSpec) Action {
+	return r.RouteLookup(dest, nil)
+}
+
+// RouteLookup returns the action for the given destination, and resolves domains
+// with lookup (if not nil) for the CIDR rules if resolution is enabled
+//
+// The destination is not changed, the resolved address is only used for matching.
+func (r *Router) RouteLookup(dest *socks5.AddrSpec, lookup func(name string) (net.IP, error)) Action {
+	table := r.table.Load().(*routeTable)
+	t := &routeTarget{dest: dest, resolve: table.resolve, lookup: lookup}
+	for _, rule := range table.rules {
+		if rule.match(t) {
+			return rule.action
+		}
+	}
+	return table.def
+}
+
+func (r *Router) load() error {
+	table, err := parseRouteTable(r.file)
+	if err != nil {
+		return err
+	}
+	r.table.Store(table)
+	return nil
+}
+
+func (r *Router) watch() {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		r.logger.Println(err)
+		return
+	}
+	defer watcher.Close()
+
+	// editors save by renaming or replacing the file, which drops a watch on the file itself,
+	// so the directories are watched and their events are filtered by file name
+	files := make(map[string]bool)
+	dirs := make(map[string]bool)
+	addFiles := func() {
+		files = make(map[string]bool)
+		for _, file := range r.table.Load().(*routeTable).files {
+			file = filepath.Clean(file)
+			files[file] = true
+			dir := filepath.Dir(file)
+			if dirs[dir] {
+				continue
+			}
+			if err := watcher.Add(dir); err != nil {
+				r.logger.Println(err)
+			} else {
+				dirs[dir] = true
+			}
+		}
+	}
+	addFiles()
+
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			if !files[filepath.Clean(event.Name)] {
+				continue
+			}
+			if event.Op&(fsnotify.Rename|fsnotify.Remove) != 0 {
+				if _, err := os.Stat(event.Name); os.IsNotExist(err) {
+					continue // the rules stay in effect until the file is created again
+				}
+			}
+			if event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename|fsnotify.Remove) != 0 {
+				if err := r.load(); err != nil {
+					r.logger.Println(err)
+				} else {
+					r.logger.Println("Routing rules reloaded")
+					addFiles()
+				}
+			}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			r.logger.Println(err)
+		}
+	}
+}
+
+func parseRouteTable(file string) (*routeTable, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	table := &routeTable{
+		def:   ActionProxy,
+		files: []string{file},
+	}
+	scanner := bufio.NewScanner(f)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		fields := strings.Fields(stripComment(scanner.Text()))
+		if len(fields) == 0 {
+			continue
+		}
+		if err := table.parseRule(fields, filepath.Dir(file)); err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", file, lineNum, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return table, nil
+}
+
+func (table *routeTable) parseRule(fields []string, dir string) error {
+	switch fields[0] {
+	case "resolve":
+		if len(fields) != 1 {
+			return fmt.Errorf("resolve takes no arguments")
+		}
+		table.resolve = true
+		return nil
+	case "default", "plain", "private":
+		if len(fields) != 2 {
+			return fmt.Errorf("%s expects an action", fields[0])
+		}
+	default:
+		if len(fields) != 3 {
+			return fmt.Errorf("%s expects a value and an action", fields[0])
+		}
+	}
+
+	action := Action(fields[len(fields)-1])
+	if len(action) == 0 {
+		return fmt.Errorf("missing action")
+	}
+
+	var match func(t *routeTarget) bool
+	switch fields[0] {
+	case "default":
+		table.def = action
+		return nil
+	case "plain":
+		match = func(t *routeTarget) bool {
+			return len(t.dest.FQDN) > 0 && !strings.Contains(t.dest.FQDN, ".")
+		}
+	case "private":
+		match = func(t *routeTarget) bool {
+			ip := t.ip()
+			return ip != nil && isPrivateIP(ip)
+		}
+	case "domain":
+		domain := normalizeDomain(fields[1])
+		match = func(t *routeTarget) bool {
+			return t.domain() == domain
+		}
+	case "domain-suffix":
+		suffix := normalizeDomain(fields[1])
+		match = func(t *routeTarget) bool {
+			return hasDomainSuffix(t.domain(), suffix)
+		}
+	case "domain-regex":
+		re, err := regexp.Compile(fields[1])
+		if err != nil {
+			return err
+		}
+		match = func(t *routeTarget) bool {
+			domain := t.domain()
+			return len(domain) > 0 && re.MatchString(domain)
+		}
+	case "cidr":
+		block, err := parseCIDR(fields[1])
+		if err != nil {
+			return err
+		}
+		match = func(t *routeTarget) bool {
+			ip := t.ip()
+			return ip != nil && block.Contains(ip)
+		}
+	case "port":
+		from, to, err := parsePortRange(fields[1])
+		if err != nil {
+			return err
+		}
+		match = func(t *routeTarget) bool {
+			return t.dest.Port >= from && t.dest.Port <= to
+		}
+	case "list":
+		file := fields[1]
+		if !filepath.IsAbs(file) {
+			file = filepath.Join(dir, file)
+		}
+		list, err := loadRouteList(file)
+		if err != nil {
+			return err
+		}
+		table.files = append(table.files, file)
+		match = list.match
+	default:
+		return fmt.Errorf("unknown rule type: %s", fields[0])
+	}
+
+	table.rules = append(table.rules, routeRule{match: match, action: action})
+	return nil
+}
+
+type routeList struct {
+	domains map[string]bool
+	blocks  []*net.IPNet
+}
+
+func loadRouteList(file string) (*routeList, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	list := &routeList{domains: make(map[string]bool)}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		entry := strings.TrimSpace(stripComment(scanner.Text()))
+		if len(entry) == 0 {
+			continue
+		}
+		if block, err := parseCIDR(entry); err == nil {
+			list.blocks = append(list.blocks, block)
+		} else {
+			list.domains[normalizeDomain(entry)] = true
+		}
+	}
+	return list, scanner.Err()
+}
+
+func (list *routeList) match(t *routeTarget) bool {
+	for domain := t.domain(); len(domain) > 0; {
+		if list.domains[domain] {
+			return true
+		}
+		i := strings.IndexByte(domain, '.')
+		if i < 0 {
+			break
+		}
+		domain = domain[i+1:]
+	}
+
+	if len(list.blocks) == 0 {
+		return false
+	}
+	ip := t.ip()
+	if ip == nil {
+		return false
+	}
+	for _, block := range list.blocks {
+		if block.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+type routeTarget struct {
+	dest       *socks5.AddrSpec
+	resolve    bool
+	lookup     func(name string) (net.IP, error)
+	resolved   bool
+	resolvedIP net.IP
+}
+
+func (t *routeTarget) domain() string {
+	return normalizeDomain(t.dest.FQDN)
+}
+
+// ip returns the IP address of the destination and resolves it if necessary and enabled
+func (t *routeTarget) ip() net.IP {
+	if t.dest.IP != nil || len(t.dest.FQDN) == 0 {
+		return t.dest.IP
+	}
+	if ip := net.ParseIP(t.dest.FQDN); ip != nil {
+		return ip
+	}
+	if t.resolve && !t.resolved {
+		t.resolved = true
+		lookup := t.lookup
+		if lookup == nil {
+			lookup = lookupIP
+		}
+		if ip, err := lookup(t.dest.FQDN); err == nil {
+			t.resolvedIP = ip
+		}
+	}
+	return t.resolvedIP
+}
+
+// lookupIP resolves a domain with the system resolver
+func lookupIP(name string) (net.IP, error) {
+	ips, err := net.LookupIP(name)
+	if err != nil {
+		return nil, err
+	}
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("no addresses found for %s", name)
+	}
+	return ips[0], nil
+}
+
+func normalizeDomain(domain string) string {
+	return strings.TrimSuffix(strings.ToLower(domain), ".")
+}
+
+func hasDomainSuffix(domain, suffix string) bool {
+	return domain == suffix || strings.HasSuffix(domain, "."+suffix)
+}
+
+func parseCIDR(s string) (*net.IPNet, error) {
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IP address: %s", s)
+		}
+		if ip.To4() != nil {
+			return &net.IPNet{IP: ip.To4(), Mask: net.CIDRMask(32, 32)}, nil
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+	}
+	_, block, err := net.ParseCIDR(s)
+	return block, err
+}
+
+func parsePortRange(s string) (from, to int, err error) {
+	parts := strings.SplitN(s, "-", 2)
+	if from, err = strconv.Atoi(parts[0]); err != nil {
+		return
+	}
+	to = from
+	if len(parts) == 2 {
+		if to, err = strconv.Atoi(parts[1]); err != nil {
+			return
+		}
+	}
+	if from < 0 || to > 65535 || from > to {
+		err = fmt.Errorf("invalid port range: %s", s)
+	}
+	return
+}
+
+func stripComment(line string) string {
+	if i := strings.IndexByte(line, '#'); i >= 0 {
+		return line[:i]
+	}
+	return line
+}
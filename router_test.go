@@ -0,0 +1,83 @@
+package razproxy
+
+import (
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/armon/go-socks5"
+)
+
+func TestRouterResolve(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "rules.txt")
+	if err := os.WriteFile(file, []byte("resolve\ncidr 10.0.0.0/8 reject\ndefault direct\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	r, err := LoadRouter(file, log.New(io.Discard, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var lookups []string
+	lookup := func(name string) (net.IP, error) {
+		lookups = append(lookups, name)
+		return net.IPv4(10, 1, 2, 3), nil
+	}
+	dest := &socks5.AddrSpec{FQDN: "internal.example", Port: 80}
+	if action := r.RouteLookup(dest, lookup); action != ActionReject {
+		t.Fatalf("expected reject, got %s", action)
+	}
+	if len(lookups) != 1 || lookups[0] != "internal.example" {
+		t.Fatalf("unexpected lookups: %v", lookups)
+	}
+	if dest.IP != nil {
+		t.Fatalf("the destination was changed to %s", dest.IP)
+	}
+}
+
+func TestRouterWatch(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "rules.txt")
+	if err := os.WriteFile(file, []byte("default proxy\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	r, err := LoadRouter(file, log.New(io.Discard, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dest := &socks5.AddrSpec{FQDN: "example.com", Port: 80}
+
+	// saves by replacing the file, as editors do, until the router picks them up
+	save := func(action Action) {
+		deadline := time.Now().Add(5 * time.Second)
+		for r.Route(dest) != action {
+			if time.Now().After(deadline) {
+				t.Fatalf("rules were not reloaded, got %s instead of %s", r.Route(dest), action)
+			}
+			tmp := filepath.Join(dir, "rules.txt.tmp")
+			if err := os.WriteFile(tmp, []byte("default "+action+"\n"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Rename(tmp, file); err != nil {
+				t.Fatal(err)
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+	save(ActionDirect)
+	save(ActionReject)
+
+	// removed files keep their rules until they are created again
+	if err := os.Remove(file); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if action := r.Route(dest); action != ActionReject {
+		t.Fatalf("expected reject, got %s", action)
+	}
+	save(ActionDirect)
+}
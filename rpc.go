@@ -1,24 +1,144 @@
 package razproxy
 
-// RPC ...
+import (
+	"net"
+	"net/rpc"
+	"time"
+)
+
+// RPC serves the net/rpc control protocol of clients older than the versioned one
 type RPC struct {
 	session *serverSession
 }
 
+// serveLegacyControl serves the net/rpc protocol on conn, or rejects the
+// client if the server has RejectLegacyClients set
+func (s *serverSession) serveLegacyControl(conn net.Conn) {
+	s.srv.settingsMtx.RLock()
+	reject := s.srv.RejectLegacyClients
+	s.srv.settingsMtx.RUnlock()
+
+	rpcServ := rpc.NewServer()
+	var err error
+	if reject {
+		err = rpcServ.RegisterName("RPC", &legacyRejectRPC{session: s})
+	} else {
+		s.log("client uses the legacy control protocol")
+		err = rpcServ.Register(&RPC{session: s})
+	}
+	if err != nil {
+		s.log("rpc error: ", err)
+		return
+	}
+	rpcServ.ServeConn(conn)
+}
+
+// legacyRejectRPC fails the authentication of older clients, which don't retry
+// after that
+type legacyRejectRPC struct {
+	session *serverSession
+}
+
+// Auth ...
+func (rpc *legacyRejectRPC) Auth(req *AuthRequest, result *AuthResult) error {
+	rpc.session.log("client uses the legacy control protocol - closing session")
+	result.Reason = "client is too old, please upgrade"
+	go func() {
+		time.Sleep(time.Second)
+		rpc.session.session.Close()
+	}()
+	return nil
+}
+
 // Auth is an RPC function to authenticate the client
 func (rpc *RPC) Auth(req *AuthRequest, result *AuthResult) error {
-	result.ID, result.OK = rpc.session.auth(req.User, req.Password)
+	id, err := rpc.session.auth(req)
+	if err != nil {
+		result.Reason, result.Retry = authFailure(err)
+		return nil
+	}
+	result.OK = true
+	result.ID = id
+	user, _, _ := rpc.session.identity()
+	result.User = user
+	result.Token = rpc.session.srv.issueToken(id, user)
+	return nil
+}
+
+// Ping is an RPC function that echoes its request so clients can measure the round-trip time
+func (rpc *RPC) Ping(req *PingRequest, result *PingResult) error {
+	result.Seq = req.Seq
 	return nil
 }
 
+// Reverse is an RPC function to make the server listen on an address and forward connections to the client
+func (rpc *RPC) Reverse(req *ReverseRequest, result *ReverseResult) (err error) {
+	result.ID, result.Addr, err = rpc.session.reverse(req.Addr)
+	return
+}
+
+// legacyControl speaks the net/rpc control protocol of servers older than the versioned one
+type legacyControl struct {
+	*rpc.Client
+}
+
+var legacyMethods = map[string]string{
+	"auth":    "RPC.Auth",
+	"ping":    "RPC.Ping",
+	"reverse": "RPC.Reverse",
+}
+
+func (c legacyControl) call(method string, params, result interface{}) error {
+	return c.Call(legacyMethods[method], params, result)
+}
+
+// has returns false, because the older servers only know the Auth method
+func (c legacyControl) has(feature string) bool {
+	return false
+}
+
 // AuthRequest ...
 type AuthRequest struct {
-	User     string
-	Password string
+	User     string `json:"user,omitempty"`
+	Password string `json:"password,omitempty"`
+	Join     string `json:"join,omitempty"`  // ID of an existing session to share the identity of
+	Token    string `json:"token,omitempty"` // session token of a previous session to resume
+	// CredentialType selects how Credential is validated instead of User and
+	// Password (CredentialBearer, CredentialJWT or CredentialHMAC)
+	CredentialType string `json:"credential_type,omitempty"`
+	Credential     string `json:"credential,omitempty"`
 }
 
 // AuthResult ...
 type AuthResult struct {
-	OK bool
-	ID string
+	OK    bool   `json:"ok"`
+	ID    string `json:"id"`
+	Token string `json:"token,omitempty"` // session token to resume the session with on reconnect
+	User  string `json:"user"`            // the user the credentials belong to
+	// Reason explains why the authentication failed, and Retry tells whether the
+	// same credentials may be accepted later, e.g. after a backend error. The
+	// control protocol reports these as errors instead.
+	Reason string `json:"-"`
+	Retry  bool   `json:"-"`
+}
+
+// PingRequest ...
+type PingRequest struct {
+	Seq uint64 `json:"seq"`
+}
+
+// PingResult ...
+type PingResult struct {
+	Seq uint64 `json:"seq"`
+}
+
+// ReverseRequest ...
+type ReverseRequest struct {
+	Addr string `json:"addr"`
+}
+
+// ReverseResult ...
+type ReverseResult struct {
+	ID   uint32 `json:"id"` // sent at the beginning of each stream the server opens for this listener
+	Addr string `json:"addr"`
 }
@@ -1,9 +1,14 @@
 package razproxy
 
 import (
+	"context"
 	"crypto/tls"
+	"errors"
+	"io"
 	"log"
 	"net"
+	"net/http"
+	"sync"
 	"time"
 
 	"golang.org/x/time/rate"
@@ -11,16 +16,62 @@ import (
 
 // Server ...
 type Server struct {
-	auth        Authenticator
-	tlsConf     *tls.Config
-	rate        *rateLimiter
-	Logger      *log.Logger
-	ExternalDNS string
-	LAN         bool
+	auth          ContextAuthenticator
+	tlsConf       *tls.Config
+	rate          *rateLimiter
+	Logger        *log.Logger
+	ExternalDNS   string
+	LAN           bool
+	Tunnel        *TunnelConfig
+	WebSocketPath string              // accept WebSocket tunnels on this HTTP path
+	Decoy         http.Handler        // serves non-tunnel HTTP requests
+	Fallback      string              // address of a backend that receives non-tunnel connections, e.g. a local web server
+	Secret        string              // pre-shared secret clients have to send before the tunnel starts
+	RequireALPN   bool                // only accept tunnels from clients that negotiate the razproxy ALPN protocol
+	Outbounds     map[string]Outbound // named outbounds that Rules, Outbound and UserOutbounds refer to
+	Outbound      string              // name of the default outbound (direct if empty)
+	UserOutbounds map[string]string   // name of the outbound per user or "@policy"
+	ReverseRules  []ReverseRule       // addresses users may listen on for reverse tunnels (disabled if empty)
+	Rules         *Router             // picks an outbound name, "direct" or "reject" per destination ("proxy" means the user's outbound)
+	// TrustedProxies lists the CIDRs of load balancers that may send PROXY protocol
+	// headers to TCP based listeners. The client address in the header is used
+	// instead of the address of the load balancer.
+	TrustedProxies   []string
+	RateLimit        rate.Limit        // rate of new tunnels per IP (one per minute by default)
+	RateBurst        int               // number of tunnels an IP may open at once (3 by default)
+	BandwidthClasses map[string]int    // bytes per second of named bandwidth classes
+	UserClasses      map[string]string // bandwidth class per user or "@policy" ("*" matches any user)
+	// FallbackRateLimit and FallbackRateBurst limit the non-tunnel connections per IP
+	// that are served by the fallback backend or the HTTP server (one per second
+	// with a burst of 30 by default)
+	FallbackRateLimit rate.Limit
+	FallbackRateBurst int
+	// TokenAuth validates the token credentials of clients per credential type
+	// (CredentialBearer, CredentialJWT or CredentialHMAC)
+	TokenAuth map[string]TokenAuthenticator
+	// RejectLegacyClients fails the login of clients that only speak the net/rpc
+	// control protocol of older versions, instead of serving them
+	RejectLegacyClients bool
+	// SessionKey signs the session tokens that clients resume their sessions with.
+	// A random key is used if empty, which invalidates the tokens on restart.
+	SessionKey       []byte
+	SessionTokenTTL  time.Duration // validity of session tokens (24 hours by default)
+	AuthTimeout      time.Duration // time the authenticator has to check the credentials of a client (10 seconds by default)
+	randomSessionKey []byte
+	fallbackRate     *rateLimiter
+	fallbackOnce     sync.Once
+	fallbackProxy    http.Handler
+	settingsMtx      sync.RWMutex // guards the settings that Reload may change
+	bandwidthMtx     sync.Mutex
+	bandwidth        map[string]*userLimiter
+	sessionsMtx      sync.Mutex
+	sessions         map[*serverSession]bool
+	listenersMtx     sync.Mutex
+	listeners        map[string]io.Closer
 }
 
 // NewServer returns a new Server
-func NewServer(auth Authenticator, certLoader CertLoader, logger *log.Logger) (*Server, error) {
+func NewServer(auth ContextAuthenticator, certLoader CertLoader, logger *log.Logger) (*Server, error) {
 	if auth == nil {
 		auth = &NilAuthenticator{}
 	}
@@ -46,40 +97,208 @@ func NewServer(auth Authenticator, certLoader CertLoader, logger *log.Logger) (*
 	}
 
 	return &Server{
-		auth:    auth,
-		tlsConf: tlsConf,
-		rate:    newRateLimiter(rate.Every(time.Minute), 3),
-		Logger:  logger,
+		auth:              auth,
+		tlsConf:           tlsConf,
+		rate:              newRateLimiter(rate.Every(time.Minute), 3),
+		fallbackRate:      newRateLimiter(rate.Every(time.Second), 30),
+		Logger:            logger,
+		RateLimit:         rate.Every(time.Minute),
+		RateBurst:         3,
+		FallbackRateLimit: rate.Every(time.Second),
+		FallbackRateBurst: 30,
+		bandwidth:         make(map[string]*userLimiter),
+		randomSessionKey:  newSessionKey(),
+		sessions:          make(map[*serverSession]bool),
+		listeners:         make(map[string]io.Closer),
 	}, nil
 }
 
 // ListenAndServe starts listening and serving requests on a given network address
+//
+// The address may be prefixed by the name of a registered transport, e.g. unix:///tmp/razproxy.sock.
+// The default transport is TLS.
 func (s *Server) ListenAndServe(address string) error {
-	ln, err := tls.Listen("tcp", address, s.tlsConf)
+	ln, err := s.Listen(address)
 	if err != nil {
 		return err
 	}
+	return s.Serve(ln)
+}
+
+// Listen opens a listener on the given address using the transport in its prefix
+func (s *Server) Listen(address string) (Listener, error) {
+	name, addr := splitTransport(address)
+	if len(name) == 0 {
+		name = TransportTLS
+	}
+	t, err := getTransport(name)
+	if err != nil {
+		return nil, err
+	}
+	return t.Listen(addr, &TransportConfig{
+		TLS:            s.serverTLSConfig(),
+		Path:           s.WebSocketPath,
+		TrustedProxies: s.TrustedProxies,
+	})
+}
+
+// Serve accepts and serves connections on the listener until it is closed
+func (s *Server) Serve(ln Listener) error {
 	defer ln.Close()
 
+	s.updateRateLimit()
+
+	httpLn := newConnListener(ln.Addr())
+	defer httpLn.Close()
+	go http.Serve(httpLn, http.HandlerFunc(s.serveHTTP))
+
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
 			s.Logger.Println("connection accept error:", err)
 			continue
 		}
 
-		ip, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
-		if !s.rate.get(ip).Allow() {
-			s.Logger.Println("rate limit exceeded for IP:", ip)
+		go s.serveConn(conn, httpLn)
+	}
+}
+
+// serveConn starts a session if the connection begins with an smux frame
+// (or the pre-shared secret) and hands it over to the fallback backend or
+// the HTTP server otherwise
+//
+// Connections that are not net.Conns are expected to carry smux frames.
+func (s *Server) serveConn(rwc io.ReadWriteCloser, httpLn *connListener) {
+	if conn, ok := rwc.(net.Conn); ok {
+		n := 1
+		if len(s.Secret) > 0 {
+			n = len(secretToken(s.Secret))
+		}
+		bufConn := newBufferedConn(conn)
+		conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+		header := peekHeader(bufConn, n)
+		conn.SetReadDeadline(time.Time{})
+		if len(header) == 0 {
 			conn.Close()
-			continue
+			return
 		}
 
-		session, err := s.newSession(conn)
-		if err != nil {
-			s.Logger.Println("smux error:", err)
-			continue
+		if !s.isTunnel(conn, header) {
+			if !s.allowFallback(conn.RemoteAddr()) {
+				conn.Close()
+				return
+			}
+			s.fallback(bufConn, httpLn)
+			return
+		}
+		if len(s.Secret) > 0 {
+			bufConn.r.Discard(n)
+		}
+		rwc = bufConn
+	} else if !s.checkSecret(rwc) {
+		rwc.Close()
+		return
+	}
+
+	// tunnels have their own rate limit, so scanners hitting the fallback backend don't use it up
+	if addrConn, ok := rwc.(interface{ RemoteAddr() net.Addr }); ok && !s.allow(addrConn.RemoteAddr()) {
+		rwc.Close()
+		return
+	}
+
+	t, err := newSmuxTunnel(rwc, s.Tunnel, true)
+	if err != nil {
+		s.Logger.Println("smux error:", err)
+		rwc.Close()
+		return
+	}
+	s.newSession(t).run()
+}
+
+// checkCredentials returns the identity the credentials belong to
+func (s *Server) checkCredentials(ctx context.Context, req *AuthRequest) (Identity, error) {
+	s.settingsMtx.RLock()
+	auth := s.auth
+	tokenAuth, isToken := s.TokenAuth[req.CredentialType]
+	s.settingsMtx.RUnlock()
+
+	if !isToken || req.CredentialType == CredentialPassword {
+		return auth.Authenticate(ctx, *req)
+	}
+	return withContext(ctx, func() (Identity, error) {
+		user, err := tokenAuth.ValidToken(req.Credential)
+		return Identity{User: user}, err
+	})
+}
+
+// authTimeout returns AuthTimeout or its default
+func (s *Server) authTimeout() time.Duration {
+	s.settingsMtx.RLock()
+	defer s.settingsMtx.RUnlock()
+	if s.AuthTimeout > 0 {
+		return s.AuthTimeout
+	}
+	return 10 * time.Second
+}
+
+// allow checks if the rate limit of the remote IP allows a new tunnel
+func (s *Server) allow(addr net.Addr) bool {
+	ip, ok := allowIP(s.rate, addr)
+	if !ok {
+		s.Logger.Println("rate limit exceeded for IP:", ip)
+	}
+	return ok
+}
+
+// allowFallback checks if the rate limit of the remote IP allows a new non-tunnel connection
+func (s *Server) allowFallback(addr net.Addr) bool {
+	ip, ok := allowIP(s.fallbackRate, addr)
+	if !ok {
+		s.Logger.Println("fallback rate limit exceeded for IP:", ip)
+	}
+	return ok
+}
+
+func allowIP(r *rateLimiter, addr net.Addr) (string, bool) {
+	ip, _, err := net.SplitHostPort(addr.String())
+	if err != nil { // not an IP network, e.g. Unix socket or pipe
+		return "", true
+	}
+	return ip, r.get(ip).Allow()
+}
+
+// updateRateLimit applies the rate limit settings to the rate limiters
+func (s *Server) updateRateLimit() {
+	s.settingsMtx.RLock()
+	defer s.settingsMtx.RUnlock()
+	s.rate.set(s.RateLimit, s.RateBurst)
+	s.fallbackRate.set(s.FallbackRateLimit, s.FallbackRateBurst)
+}
+
+func (s *Server) addSession(session *serverSession) {
+	s.sessionsMtx.Lock()
+	defer s.sessionsMtx.Unlock()
+	s.sessions[session] = true
+}
+
+func (s *Server) removeSession(session *serverSession) {
+	s.sessionsMtx.Lock()
+	defer s.sessionsMtx.Unlock()
+	delete(s.sessions, session)
+}
+
+// hasSession returns whether an authenticated session of the given user exists with the given ID
+func (s *Server) hasSession(id, user string) bool {
+	s.sessionsMtx.Lock()
+	defer s.sessionsMtx.Unlock()
+	for session := range s.sessions {
+		sessionUser, _, authenticated := session.identity()
+		if session.sessionID() == id && sessionUser == user && authenticated {
+			return true
 		}
-		go session.run()
 	}
+	return false
 }
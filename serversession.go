@@ -2,47 +2,59 @@ package razproxy
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
 	"net"
-	"net/rpc"
 	"sync"
 	"time"
 
 	"github.com/armon/go-socks5"
 	"github.com/miekg/dns"
-	"github.com/xtaci/smux"
 )
 
 type serverSession struct {
-	id            string
-	srv           *Server
-	session       *smux.Session
-	authenticated bool
-	logFilterMtx  sync.Mutex
-	logFilter     map[string]bool
-	dnsCacheMtx   sync.Mutex
-	dnsCache      map[string]net.IP
-}
-
-func (s *Server) newSession(conn io.ReadWriteCloser) (*serverSession, error) {
-	session, err := smux.Server(conn, nil)
-	if err != nil {
-		return nil, err
-	}
+	id               string
+	srv              *Server
+	session          tunnel
+	identityMtx      sync.RWMutex // guards id, user, policy, credentials, authenticated and revoked
+	user             string
+	policy           string             // assigned by the authenticator
+	credentials      sessionCredentials // checked again on reload
+	authenticated    bool
+	revoked          bool // set by Reload if the user is no longer accepted, so new streams are rejected
+	logFilterMtx     sync.Mutex
+	logFilter        map[string]bool
+	dnsCacheMtx      sync.Mutex
+	dnsCache         map[string]net.IP
+	reverseSeq       uint32
+	reverseMtx       sync.Mutex
+	reverseListeners []net.Listener
+	reverseClosed    bool
+	connected        time.Time
+	bytesUp          int64
+	bytesDown        int64
+	streamsMtx       sync.Mutex
+	streams          map[*trackedConn]bool
+}
 
+func (s *Server) newSession(t tunnel) *serverSession {
 	return &serverSession{
 		id:        uniqueID(),
 		srv:       s,
-		session:   session,
+		session:   t,
 		logFilter: make(map[string]bool),
 		dnsCache:  make(map[string]net.IP),
-	}, nil
+		connected: time.Now(),
+		streams:   make(map[*trackedConn]bool),
+	}
 }
 
 func (s *serverSession) run() {
+	s.srv.addSession(s)
+	defer s.srv.removeSession(s)
 	defer s.Close()
 
 	s.log(s.session.RemoteAddr().String(), " connected")
@@ -50,6 +62,7 @@ func (s *serverSession) run() {
 	socks5Conf := &socks5.Config{
 		Resolver: s,
 		Rules:    s,
+		Dial:     s.Dial,
 		Logger:   log.New(ioutil.Discard, "", 0),
 	}
 	socks5Srv, err := socks5.New(socks5Conf)
@@ -58,21 +71,14 @@ func (s *serverSession) run() {
 		return
 	}
 
-	rpcServ := rpc.NewServer()
-	err = rpcServ.Register(&RPC{session: s})
-	if err != nil {
-		s.log("rpc error: ", err)
-		return
-	}
-
-	rpcConn, err := s.session.AcceptStream()
+	controlConn, err := s.session.AcceptStream()
 	if err != nil {
 		s.log("stream error: ", err)
 		return
 	}
 	go func() {
-		defer rpcConn.Close()
-		rpcServ.ServeConn(rpcConn)
+		defer controlConn.Close()
+		s.serveControl(controlConn)
 	}()
 
 	for {
@@ -83,44 +89,176 @@ func (s *serverSession) run() {
 			}
 			return
 		}
-		if !s.authenticated {
+		if _, _, authenticated := s.identity(); !authenticated {
+			if s.isRevoked() {
+				go s.rejectStream(stream)
+				continue
+			}
 			s.log("client not authenticated yet! - closing session")
 			return
 		}
 		go func() {
 			defer stream.Close()
-			socks5Srv.ServeConn(stream)
+			socks5Srv.ServeConn(&socksStream{stream})
 		}()
 	}
 }
 
+// rejectStream answers the SOCKS request of a stream with a ruleset failure
+//
+// The stream is not closed right away, because the close could reach the
+// client before it registered the stream, which would then wait forever.
+func (s *serverSession) rejectStream(stream net.Conn) {
+	defer stream.Close()
+	stream.SetReadDeadline(time.Now().Add(10 * time.Second))
+	if _, err := readSocksRequest(stream); err == nil {
+		writeSocksReply(stream, ruleFailure)
+	}
+}
+
 func (s *serverSession) Close() error {
 	s.log("connection closed")
+	s.closeReverse()
 	return s.session.Close()
 }
 
-func (s *serverSession) auth(user, pw string) (string, bool) {
-	s.authenticated = s.srv.auth.Valid(user, pw)
-	if s.authenticated {
-		s.log("auth successful")
-	} else {
-		s.log("auth failed - closing session")
+// auth checks the credentials of the client and returns the ID of the session
+//
+// The authenticator has AuthTimeout to decide, after that the error is context.DeadlineExceeded.
+// Clients resuming their session with a session token are checked the same way,
+// so users who are no longer accepted can't resume.
+func (s *serverSession) auth(req *AuthRequest) (string, error) {
+	credentials := AuthRequest{
+		User:           req.User,
+		Password:       req.Password,
+		CredentialType: req.CredentialType,
+		Credential:     req.Credential,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.srv.authTimeout())
+	defer cancel()
+	id, err := s.srv.checkCredentials(ctx, &credentials)
+
+	if err != nil {
+		s.log("auth failed (", err, ") - closing session")
 		go func() {
 			time.Sleep(time.Second)
 			s.session.Close()
 		}()
+		return s.sessionID(), err
+	}
+
+	sessionID := s.sessionID()
+	if len(req.Token) > 0 {
+		if t, err := s.srv.verifyToken(req.Token); err != nil {
+			s.log("cannot resume session: ", err)
+		} else if t.User != id.User {
+			s.log("cannot resume session of another user")
+		} else {
+			s.log("resuming session ", t.ID)
+			sessionID = t.ID
+		}
+	} else if len(req.Join) > 0 && s.srv.hasSession(req.Join, id.User) {
+		s.log("joining session ", req.Join)
+		sessionID = req.Join
+	}
+	s.setIdentity(sessionID, id, newSessionCredentials(&credentials, id))
+	s.log("auth successful as ", id.User)
+	return sessionID, nil
+}
+
+func (s *serverSession) setIdentity(sessionID string, id Identity, credentials sessionCredentials) {
+	s.identityMtx.Lock()
+	defer s.identityMtx.Unlock()
+	s.id = sessionID
+	s.user = id.User
+	s.policy = id.Policy
+	s.credentials = credentials
+	s.authenticated = true
+	s.revoked = false
+}
+
+// revoke deauthenticates the session, which keeps running without accepting new streams
+func (s *serverSession) revoke() {
+	s.identityMtx.Lock()
+	s.authenticated = false
+	s.revoked = true
+	s.identityMtx.Unlock()
+	s.closeReverse()
+}
+
+func (s *serverSession) isRevoked() bool {
+	s.identityMtx.RLock()
+	defer s.identityMtx.RUnlock()
+	return s.revoked
+}
+
+// identity returns the user and policy of the session, and whether it is authenticated
+func (s *serverSession) identity() (user, policy string, authenticated bool) {
+	s.identityMtx.RLock()
+	defer s.identityMtx.RUnlock()
+	return s.user, s.policy, s.authenticated
+}
+
+// sessionID returns the ID of the session, which changes if the client resumes or joins another session
+func (s *serverSession) sessionID() string {
+	s.identityMtx.RLock()
+	defer s.identityMtx.RUnlock()
+	return s.id
+}
+
+// authFailure returns the reason of an authentication error that is reported to
+// the client, and whether the client may retry with the same credentials
+//
+// Backend errors are not reported in detail, because they may reveal internals.
+func authFailure(err error) (reason string, retry bool) {
+	switch {
+	case errors.Is(err, ErrInvalidCredentials):
+		return err.Error(), false
+	case errors.Is(err, context.DeadlineExceeded):
+		return "authentication timed out", true
+	default:
+		return "authentication backend unavailable", true
 	}
-	return s.id, s.authenticated
 }
 
 // Allow implements socks5.RuleSet
 func (s *serverSession) Allow(ctx context.Context, req *socks5.Request) (context.Context, bool) {
 	go s.filterLog("PROXY: ", req.DestAddr.String())
-	return ctx, s.srv.LAN || !isPrivateIP(req.DestAddr.IP)
+	s.srv.settingsMtx.RLock()
+	lan := s.srv.LAN
+	s.srv.settingsMtx.RUnlock()
+	outbound, ok := s.pickOutbound(req.DestAddr)
+	if !ok {
+		return ctx, false
+	}
+	if resolveLocally(outbound) && len(req.DestAddr.FQDN) > 0 && req.DestAddr.IP == nil {
+		ip, err := s.lookup(req.DestAddr.FQDN)
+		if err != nil {
+			return ctx, false
+		}
+		req.DestAddr.IP = ip
+	}
+	if !lan && isPrivateIP(req.DestAddr.IP) {
+		return ctx, false
+	}
+	return context.WithValue(ctx, outboundKey{}, &outboundRequest{
+		outbound: outbound,
+		addr:     outboundAddr(outbound, req.DestAddr),
+	}), true
 }
 
 // Resolve implements socks5.NameResolver
+//
+// The name is resolved in Allow instead, once it is known whether the request
+// goes through a proxy outbound, which receives the name unresolved. Rules see
+// the name only, so their CIDR rules match domains if the rules resolve them.
 func (s *serverSession) Resolve(ctx context.Context, name string) (context.Context, net.IP, error) {
+	return ctx, nil, nil
+}
+
+// lookup resolves a name using the DNS cache of the session
+func (s *serverSession) lookup(name string) (net.IP, error) {
 	s.dnsCacheMtx.Lock()
 	ip, ok := s.dnsCache[name]
 	s.dnsCacheMtx.Unlock()
@@ -138,11 +276,21 @@ func (s *serverSession) Resolve(ctx context.Context, name string) (context.Conte
 		}
 	}
 
-	return ctx, ip, err
+	return ip, err
+}
+
+func (s *serverSession) flushDNSCache() {
+	s.dnsCacheMtx.Lock()
+	defer s.dnsCacheMtx.Unlock()
+	s.dnsCache = make(map[string]net.IP)
 }
 
 func (s *serverSession) resolve(name string) (net.IP, error) {
-	if len(s.srv.ExternalDNS) > 0 {
+	s.srv.settingsMtx.RLock()
+	externalDNS := s.srv.ExternalDNS
+	s.srv.settingsMtx.RUnlock()
+
+	if len(externalDNS) > 0 {
 		req := new(dns.Msg)
 		req.Id = dns.Id()
 		req.MsgHdr.RecursionDesired = true
@@ -151,7 +299,7 @@ func (s *serverSession) resolve(name string) (net.IP, error) {
 			{Name: dns.Fqdn(name), Qtype: dns.TypeAAAA, Qclass: dns.ClassINET},
 		}
 		req.SetEdns0(4096, true)
-		answer, _, err := new(dns.Client).Exchange(req, s.srv.ExternalDNS)
+		answer, _, err := new(dns.Client).Exchange(req, externalDNS)
 		if err != nil {
 			return nil, err
 		}
@@ -177,7 +325,7 @@ func (s *serverSession) resolve(name string) (net.IP, error) {
 }
 
 func (s *serverSession) log(a ...interface{}) {
-	s.srv.Logger.Printf("[%s] %s", s.id, fmt.Sprint(a...))
+	s.srv.Logger.Printf("[%s] %s", s.sessionID(), fmt.Sprint(a...))
 }
 
 func (s *serverSession) filterLog(a ...interface{}) {
@@ -191,7 +339,7 @@ func (s *serverSession) filterLog(a ...interface{}) {
 	reqStr := fmt.Sprint(a...)
 	if !s.logFilter[reqStr] {
 		s.logFilter[reqStr] = true
-		s.srv.Logger.Printf("[%s] %s", s.id, reqStr)
+		s.srv.Logger.Printf("[%s] %s", s.sessionID(), reqStr)
 		go func() {
 			time.Sleep(time.Minute * 5)
 			s.logFilterMtx.Lock()
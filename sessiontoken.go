@@ -0,0 +1,85 @@
+package razproxy
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// sessionToken is issued to authenticated clients, so they can resume their session on reconnect
+type sessionToken struct {
+	ID      string `json:"id"`
+	User    string `json:"user"`
+	Expires int64  `json:"exp"`
+}
+
+func newSessionKey() []byte {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		panic(err)
+	}
+	return key
+}
+
+// issueToken returns a signed session token for a session ID and user
+func (s *Server) issueToken(id, user string) string {
+	ttl := s.SessionTokenTTL
+	if ttl == 0 {
+		ttl = 24 * time.Hour
+	}
+	payload, _ := json.Marshal(&sessionToken{
+		ID:      id,
+		User:    user,
+		Expires: time.Now().Add(ttl).Unix(),
+	})
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	return encoded + "." + base64.RawURLEncoding.EncodeToString(s.signToken(encoded))
+}
+
+// verifyToken checks the signature and expiry of a session token
+func (s *Server) verifyToken(token string) (*sessionToken, error) {
+	encoded, sig, ok := strings.Cut(token, ".")
+	if !ok {
+		return nil, fmt.Errorf("malformed session token")
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil || !hmac.Equal(mac, s.signToken(encoded)) {
+		return nil, fmt.Errorf("invalid session token signature")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	}
+	t := new(sessionToken)
+	if err := json.Unmarshal(payload, t); err != nil {
+		return nil, err
+	}
+	if time.Now().Unix() > t.Expires {
+		return nil, fmt.Errorf("session token expired")
+	}
+	return t, nil
+}
+
+func (s *Server) signToken(encoded string) []byte {
+	mac := hmac.New(sha256.New, s.sessionKey())
+	mac.Write([]byte(encoded))
+	return mac.Sum(nil)
+}
+
+func (s *Server) sessionKey() []byte {
+	if len(s.SessionKey) > 0 {
+		return s.SessionKey
+	}
+	return s.randomSessionKey
+}
+
+// sessionTicketKey derives the TLS session ticket key from SessionKey,
+// so TLS sessions can also be resumed across restarts and servers
+func (s *Server) sessionTicketKey() [32]byte {
+	return sha256.Sum256(append([]byte("razproxy-tls-ticket:"), s.SessionKey...))
+}
@@ -0,0 +1,227 @@
+package razproxy
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/armon/go-socks5"
+)
+
+const (
+	socks5Version = uint8(5)
+	ipv4Address   = uint8(1)
+	fqdnAddress   = uint8(3)
+	ipv6Address   = uint8(4)
+)
+
+const (
+	successReply uint8 = iota
+	serverFailure
+	ruleFailure
+	networkUnreachable
+	hostUnreachable
+	connectionRefused
+	ttlExpired
+	commandNotSupported
+	addrTypeNotSupported
+)
+
+// SocksError is returned when the server refuses a proxy request
+type SocksError uint8
+
+func (e SocksError) Error() string {
+	switch uint8(e) {
+	case serverFailure:
+		return "general SOCKS server failure"
+	case ruleFailure:
+		return "connection not allowed by ruleset"
+	case networkUnreachable:
+		return "network unreachable"
+	case hostUnreachable:
+		return "host unreachable"
+	case connectionRefused:
+		return "connection refused"
+	case ttlExpired:
+		return "TTL expired"
+	case commandNotSupported:
+		return "command not supported"
+	case addrTypeNotSupported:
+		return "address type not supported"
+	default:
+		return fmt.Sprintf("unknown SOCKS error: %d", uint8(e))
+	}
+}
+
+// readSocksRequest performs the server side of a no-auth SOCKS5 handshake
+// and returns the requested CONNECT destination
+func readSocksRequest(conn io.ReadWriter) (*socks5.AddrSpec, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return nil, err
+	}
+	if header[0] != socks5Version {
+		return nil, fmt.Errorf("unsupported SOCKS version: %d", header[0])
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return nil, err
+	}
+	if !hasMethod(methods, socks5.NoAuth) {
+		conn.Write([]byte{socks5Version, 0xff})
+		return nil, fmt.Errorf("no supported SOCKS auth method")
+	}
+	if _, err := conn.Write([]byte{socks5Version, socks5.NoAuth}); err != nil {
+		return nil, err
+	}
+
+	request := make([]byte, 3)
+	if _, err := io.ReadFull(conn, request); err != nil {
+		return nil, err
+	}
+	dest, err := readAddrSpec(conn)
+	if err != nil {
+		writeSocksReply(conn, addrTypeNotSupported)
+		return nil, err
+	}
+	if request[1] != socks5.ConnectCommand {
+		writeSocksReply(conn, commandNotSupported)
+		return nil, fmt.Errorf("unsupported SOCKS command: %d", request[1])
+	}
+	return dest, nil
+}
+
+// socksConnect performs the client side of a no-auth SOCKS5 handshake on conn
+func socksConnect(conn io.ReadWriter, dest *socks5.AddrSpec) error {
+	msg := []byte{socks5Version, 1, socks5.NoAuth, socks5Version, socks5.ConnectCommand, 0}
+	msg = append(msg, marshalAddrSpec(dest)...)
+	if _, err := conn.Write(msg); err != nil {
+		return err
+	}
+
+	method := make([]byte, 2)
+	if _, err := io.ReadFull(conn, method); err != nil {
+		return err
+	}
+	if method[1] != socks5.NoAuth {
+		return fmt.Errorf("unexpected SOCKS auth method: %d", method[1])
+	}
+	reply := make([]byte, 3)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if _, err := readAddrSpec(conn); err != nil {
+		return err
+	}
+	if reply[1] != successReply {
+		return SocksError(reply[1])
+	}
+	return nil
+}
+
+func writeSocksReply(w io.Writer, code uint8) error {
+	_, err := w.Write([]byte{socks5Version, code, 0, ipv4Address, 0, 0, 0, 0, 0, 0})
+	return err
+}
+
+// socksReplyCode returns the SOCKS reply code that best describes err
+func socksReplyCode(err error) uint8 {
+	if err, ok := err.(SocksError); ok {
+		return uint8(err)
+	}
+	if err == ErrNoServer {
+		return serverFailure
+	}
+	msg := err.Error()
+	if strings.Contains(msg, "refused") {
+		return connectionRefused
+	} else if strings.Contains(msg, "network is unreachable") {
+		return networkUnreachable
+	}
+	return hostUnreachable
+}
+
+func readAddrSpec(r io.Reader) (*socks5.AddrSpec, error) {
+	d := &socks5.AddrSpec{}
+
+	addrType := make([]byte, 1)
+	if _, err := io.ReadFull(r, addrType); err != nil {
+		return nil, err
+	}
+
+	switch addrType[0] {
+	case ipv4Address:
+		addr := make([]byte, 4)
+		if _, err := io.ReadFull(r, addr); err != nil {
+			return nil, err
+		}
+		d.IP = net.IP(addr)
+	case ipv6Address:
+		addr := make([]byte, 16)
+		if _, err := io.ReadFull(r, addr); err != nil {
+			return nil, err
+		}
+		d.IP = net.IP(addr)
+	case fqdnAddress:
+		if _, err := io.ReadFull(r, addrType); err != nil {
+			return nil, err
+		}
+		fqdn := make([]byte, addrType[0])
+		if _, err := io.ReadFull(r, fqdn); err != nil {
+			return nil, err
+		}
+		d.FQDN = string(fqdn)
+	default:
+		return nil, fmt.Errorf("unrecognized address type: %d", addrType[0])
+	}
+
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(r, port); err != nil {
+		return nil, err
+	}
+	d.Port = int(port[0])<<8 | int(port[1])
+	return d, nil
+}
+
+func marshalAddrSpec(addr *socks5.AddrSpec) []byte {
+	var b []byte
+	switch {
+	case len(addr.FQDN) > 0:
+		b = append([]byte{fqdnAddress, byte(len(addr.FQDN))}, addr.FQDN...)
+	case addr.IP.To4() != nil:
+		b = append([]byte{ipv4Address}, addr.IP.To4()...)
+	default:
+		b = append([]byte{ipv6Address}, addr.IP.To16()...)
+	}
+	return append(b, byte(addr.Port>>8), byte(addr.Port))
+}
+
+func hasMethod(methods []byte, method uint8) bool {
+	for _, m := range methods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+// parseAddrSpec converts a host:port address to an AddrSpec
+func parseAddrSpec(addr string) (*socks5.AddrSpec, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil, err
+	}
+	dest := &socks5.AddrSpec{Port: port}
+	if ip := net.ParseIP(host); ip != nil {
+		dest.IP = ip
+	} else {
+		dest.FQDN = host
+	}
+	return dest, nil
+}
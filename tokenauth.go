@@ -0,0 +1,115 @@
+package razproxy
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Credential types of AuthRequest
+const (
+	CredentialPassword = ""       // User and Password
+	CredentialBearer   = "bearer" // opaque bearer token
+	CredentialJWT      = "jwt"    // JWT issued by an identity provider
+	CredentialHMAC     = "hmac"   // time-limited token signed with a shared secret
+)
+
+// ErrTokenExpired is wrapped along with ErrInvalidCredentials by the errors of
+// expired tokens
+//
+// Tokens are short-lived and only have to be valid at login, so Reload keeps the
+// sessions whose token expired since.
+var ErrTokenExpired = errors.New("token expired")
+
+// tokenExpiredError is returned for expired tokens and matches both ErrInvalidCredentials and ErrTokenExpired
+type tokenExpiredError struct {
+	reason string
+}
+
+func tokenExpiredf(format string, args ...interface{}) error {
+	return &tokenExpiredError{fmt.Sprintf(format, args...)}
+}
+
+func (e *tokenExpiredError) Error() string {
+	return ErrInvalidCredentials.Error() + ": " + e.reason
+}
+
+func (e *tokenExpiredError) Unwrap() []error {
+	return []error{ErrInvalidCredentials, ErrTokenExpired}
+}
+
+// TokenAuthenticator validates a token credential and returns the user it belongs to
+//
+// Like with ContextAuthenticator, errors wrapping ErrInvalidCredentials mean that the
+// token is rejected, other errors mean that it could not be checked. Errors of
+// expired tokens should also wrap ErrTokenExpired.
+type TokenAuthenticator interface {
+	ValidToken(token string) (user string, err error)
+}
+
+// BearerAuthenticator maps static bearer tokens to users
+type BearerAuthenticator map[string]string
+
+// ValidToken ...
+func (auth BearerAuthenticator) ValidToken(token string) (string, error) {
+	for t, user := range auth {
+		if hmac.Equal([]byte(t), []byte(token)) {
+			return user, nil
+		}
+	}
+	return "", invalidCredentialsf("unknown bearer token")
+}
+
+// HMACAuthenticator validates the time-limited tokens made by NewHMACToken
+type HMACAuthenticator struct {
+	Secret []byte
+}
+
+// NewHMACToken returns a token of the user that expires after ttl
+//
+// The token is in the form of base64(user).expiry.base64(signature).
+func NewHMACToken(secret []byte, user string, ttl time.Duration) string {
+	payload := base64.RawURLEncoding.EncodeToString([]byte(user)) + "." + strconv.FormatInt(time.Now().Add(ttl).Unix(), 10)
+	return payload + "." + base64.RawURLEncoding.EncodeToString(signHMAC(secret, payload))
+}
+
+// ValidToken ...
+func (auth *HMACAuthenticator) ValidToken(token string) (string, error) {
+	i := strings.LastIndex(token, ".")
+	if i < 0 {
+		return "", invalidCredentialsf("malformed HMAC token")
+	}
+	payload, sig := token[:i], token[i+1:]
+	mac, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil || !hmac.Equal(mac, signHMAC(auth.Secret, payload)) {
+		return "", invalidCredentialsf("invalid HMAC token signature")
+	}
+
+	encodedUser, expiry, ok := strings.Cut(payload, ".")
+	if !ok {
+		return "", invalidCredentialsf("malformed HMAC token")
+	}
+	exp, err := strconv.ParseInt(expiry, 10, 64)
+	if err != nil {
+		return "", invalidCredentialsf("malformed HMAC token expiry")
+	}
+	user, err := base64.RawURLEncoding.DecodeString(encodedUser)
+	if err != nil {
+		return "", invalidCredentialsf("malformed HMAC token user")
+	}
+	if time.Now().Unix() > exp {
+		return "", tokenExpiredf("HMAC token expired")
+	}
+	return string(user), nil
+}
+
+func signHMAC(secret []byte, payload string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(payload))
+	return mac.Sum(nil)
+}
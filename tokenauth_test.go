@@ -0,0 +1,70 @@
+package razproxy
+
+import (
+	"encoding/base64"
+	"errors"
+	"io"
+	"log"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHMACAuthenticator(t *testing.T) {
+	secret := []byte("secret")
+	auth := &HMACAuthenticator{Secret: secret}
+
+	token := NewHMACToken(secret, "alice", time.Hour)
+	if user, err := auth.ValidToken(token); err != nil || user != "alice" {
+		t.Fatalf("expected alice, got %q, %v", user, err)
+	}
+
+	tests := []struct {
+		name    string
+		token   string
+		expired bool
+	}{
+		{name: "expired", token: NewHMACToken(secret, "alice", -time.Minute), expired: true},
+		{name: "other secret", token: NewHMACToken([]byte("other"), "alice", time.Hour)},
+		{name: "tampered user", token: base64.RawURLEncoding.EncodeToString([]byte("mallory")) + token[strings.Index(token, "."):]},
+		{name: "tampered expiry", token: strings.Replace(NewHMACToken(secret, "alice", -time.Minute), ".", ".9", 1)},
+		{name: "malformed", token: "alice"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			user, err := auth.ValidToken(tt.token)
+			if !errors.Is(err, ErrInvalidCredentials) {
+				t.Fatalf("expected invalid credentials, got %q, %v", user, err)
+			}
+			if errors.Is(err, ErrTokenExpired) != tt.expired {
+				t.Fatalf("unexpected expiry: %v", err)
+			}
+		})
+	}
+}
+
+func TestReloadKeepsExpiredTokens(t *testing.T) {
+	secret := []byte("secret")
+	srv, err := NewServer(nil, nil, log.New(io.Discard, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.TokenAuth = map[string]TokenAuthenticator{CredentialHMAC: &HMACAuthenticator{Secret: secret}}
+
+	newSession := func(token string) *serverSession {
+		session := srv.newSession(nil)
+		session.setIdentity(session.id, Identity{User: "alice"}, newSessionCredentials(&AuthRequest{CredentialType: CredentialHMAC, Credential: token}, Identity{User: "alice"}))
+		srv.addSession(session)
+		return session
+	}
+	expired := newSession(NewHMACToken(secret, "alice", -time.Minute))
+	revoked := newSession(NewHMACToken([]byte("old secret"), "alice", time.Hour))
+
+	srv.Reload(nil, nil, false)
+	if _, _, authenticated := expired.identity(); !authenticated {
+		t.Error("session with an expired token was deauthenticated")
+	}
+	if _, _, authenticated := revoked.identity(); authenticated {
+		t.Error("session with a revoked token is still authenticated")
+	}
+}
@@ -0,0 +1,56 @@
+package razproxy
+
+import (
+	"net"
+
+	"github.com/armon/go-socks5"
+)
+
+// ListenAndServeTransparent accepts connections redirected by iptables/nftables
+// and tunnels them to their original destination through the server
+//
+// With tproxy set, the listener expects connections diverted by a TPROXY rule,
+// otherwise by a REDIRECT rule. Connections of the client itself must be
+// excluded from the redirection, e.g. by running it as a dedicated user.
+// Only TCP is supported, because sessions don't relay UDP. It is only
+// available on Linux.
+func (c *Client) ListenAndServeTransparent(address string, tproxy bool) error {
+	l, err := listenTransparent(address, tproxy)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			defer conn.Close()
+			if err := c.proxyTransparent(conn, tproxy); err != nil {
+				c.Logger.Println("transparent proxy error:", err)
+			}
+		}()
+	}
+}
+
+func (c *Client) proxyTransparent(conn net.Conn, tproxy bool) error {
+	var dest *net.TCPAddr
+	if tproxy {
+		dest = conn.LocalAddr().(*net.TCPAddr)
+	} else {
+		var err error
+		dest, err = originalDst(conn)
+		if err != nil {
+			return err
+		}
+	}
+
+	remote, err := c.dial(&socks5.AddrSpec{IP: dest.IP, Port: dest.Port})
+	if err != nil {
+		return err
+	}
+	defer remote.Close()
+	return relay(conn, remote)
+}
@@ -0,0 +1,79 @@
+package razproxy
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+func listenTransparent(address string, tproxy bool) (net.Listener, error) {
+	lc := &net.ListenConfig{}
+	if tproxy {
+		lc.Control = func(network, address string, c syscall.RawConn) error {
+			var err error
+			ctrlErr := c.Control(func(fd uintptr) {
+				if err = unix.SetsockoptInt(int(fd), unix.SOL_IP, unix.IP_TRANSPARENT, 1); err != nil {
+					return
+				}
+				if network == "tcp6" {
+					err = unix.SetsockoptInt(int(fd), unix.SOL_IPV6, unix.IPV6_TRANSPARENT, 1)
+				}
+			})
+			if ctrlErr != nil {
+				return ctrlErr
+			}
+			return err
+		}
+	}
+	return lc.Listen(context.Background(), "tcp", address)
+}
+
+// originalDst returns the destination of a connection before it was redirected by netfilter
+func originalDst(conn net.Conn) (*net.TCPAddr, error) {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil, fmt.Errorf("not a TCP connection")
+	}
+	rawConn, err := tcpConn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+
+	var dest *net.TCPAddr
+	ctrlErr := rawConn.Control(func(fd uintptr) {
+		if conn.LocalAddr().(*net.TCPAddr).IP.To4() != nil {
+			// sockaddr_in fits in the buffer of ipv6_mreq
+			var mreq *unix.IPv6Mreq
+			mreq, err = unix.GetsockoptIPv6Mreq(int(fd), unix.SOL_IP, unix.SO_ORIGINAL_DST)
+			if err == nil {
+				dest = &net.TCPAddr{
+					IP:   net.IPv4(mreq.Multiaddr[4], mreq.Multiaddr[5], mreq.Multiaddr[6], mreq.Multiaddr[7]),
+					Port: int(binary.BigEndian.Uint16(mreq.Multiaddr[2:4])),
+				}
+			}
+		} else {
+			// sockaddr_in6 is the first field of ip6_mtuinfo
+			var info *unix.IPv6MTUInfo
+			info, err = unix.GetsockoptIPv6MTUInfo(int(fd), unix.SOL_IPV6, unix.SO_ORIGINAL_DST)
+			if err == nil {
+				port := (*[2]byte)(unsafe.Pointer(&info.Addr.Port))
+				dest = &net.TCPAddr{
+					IP:   net.IP(info.Addr.Addr[:]),
+					Port: int(binary.BigEndian.Uint16(port[:])),
+				}
+			}
+		}
+	})
+	if ctrlErr != nil {
+		return nil, ctrlErr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("original destination unavailable: %w", err)
+	}
+	return dest, nil
+}
@@ -0,0 +1,61 @@
+package razproxy
+
+import (
+	"net"
+	"os/exec"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+// freeTestPort returns a TCP port that nothing listens on
+func freeTestPort(t *testing.T) int {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+func TestTransparentRedirect(t *testing.T) {
+	if _, err := exec.LookPath("iptables"); err != nil {
+		t.Skip("iptables not found")
+	}
+	if !runInNetNS(t) {
+		return
+	}
+	port := strconv.Itoa(freeTestPort(t))
+	ipTest(t, "route", "add", "10.1.2.0/24", "dev", "lo")
+	if out, err := exec.Command("iptables", "-t", "nat", "-A", "OUTPUT", "-p", "tcp", "-d", "10.1.2.3", "--dport", "80",
+		"-j", "REDIRECT", "--to-ports", port).CombinedOutput(); err != nil {
+		t.Skipf("cannot add REDIRECT rule: %v: %s", err, out)
+	}
+
+	c, outbound := newTestClient(t)
+	go c.ListenAndServeTransparent("127.0.0.1:"+port, false)
+	echoTest(t, func() (net.Conn, error) {
+		return net.Dial("tcp", "10.1.2.3:80")
+	})
+	if dests := outbound.getDests(); !reflect.DeepEqual(dests, []string{"10.1.2.3:80"}) {
+		t.Fatalf("expected the original destination, got %v", dests)
+	}
+}
+
+func TestTransparentTProxy(t *testing.T) {
+	if !runInNetNS(t) {
+		return
+	}
+	// the addresses are routed locally, as the policy routing of a TPROXY setup does
+	port := strconv.Itoa(freeTestPort(t))
+	ipTest(t, "route", "add", "local", "10.1.2.0/24", "dev", "lo")
+
+	c, outbound := newTestClient(t)
+	go c.ListenAndServeTransparent("0.0.0.0:"+port, true)
+	echoTest(t, func() (net.Conn, error) {
+		return net.Dial("tcp", "10.1.2.3:"+port)
+	})
+	if dests := outbound.getDests(); !reflect.DeepEqual(dests, []string{"10.1.2.3:" + port}) {
+		t.Fatalf("expected the original destination, got %v", dests)
+	}
+}
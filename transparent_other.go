@@ -0,0 +1,16 @@
+//go:build !linux
+
+package razproxy
+
+import (
+	"fmt"
+	"net"
+)
+
+func listenTransparent(address string, tproxy bool) (net.Listener, error) {
+	return nil, fmt.Errorf("transparent proxy is only supported on Linux")
+}
+
+func originalDst(conn net.Conn) (*net.TCPAddr, error) {
+	return nil, fmt.Errorf("transparent proxy is only supported on Linux")
+}
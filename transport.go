@@ -0,0 +1,332 @@
+package razproxy
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Built-in transports
+const (
+	TransportTLS       = "tls"
+	TransportTCP       = "tcp"
+	TransportUnix      = "unix"
+	TransportPipe      = "pipe"
+	TransportWebSocket = "ws"
+
+	// TransportQUIC maps the proxied streams onto QUIC streams. QUIC datagrams
+	// are not used, so it doesn't carry UDP traffic either: sessions only relay
+	// TCP streams on every transport.
+	TransportQUIC = "quic"
+)
+
+// Dialer opens connections to a server
+type Dialer interface {
+	Dial(address string) (io.ReadWriteCloser, error)
+}
+
+// Listener accepts connections from clients
+//
+// Connections that implement RemoteAddr() net.Addr are subject to rate limiting.
+type Listener interface {
+	Accept() (io.ReadWriteCloser, error)
+	Close() error
+	Addr() net.Addr
+}
+
+// TransportConfig contains the settings a transport may use
+type TransportConfig struct {
+	TLS            *tls.Config // client or server TLS config
+	Path           string      // HTTP path of WebSocket tunnels
+	HTTPProxy      *url.URL    // HTTP CONNECT proxy used by clients
+	TrustedProxies []string    // CIDRs of load balancers allowed to send PROXY protocol headers
+}
+
+// Transport creates dialers and listeners for a carrier protocol
+type Transport interface {
+	NewDialer(conf *TransportConfig) (Dialer, error)
+	Listen(address string, conf *TransportConfig) (Listener, error)
+}
+
+var (
+	transportsMtx sync.RWMutex
+	transports    = map[string]Transport{
+		TransportTLS:       tlsTransport{},
+		TransportTCP:       tcpTransport{},
+		TransportUnix:      unixTransport{},
+		TransportPipe:      newPipeTransport(),
+		TransportWebSocket: wsTransport{},
+	}
+)
+
+// RegisterTransport makes a transport available by name for servers and clients
+//
+// Server addresses can refer to it as name://address.
+func RegisterTransport(name string, t Transport) {
+	transportsMtx.Lock()
+	defer transportsMtx.Unlock()
+	transports[name] = t
+}
+
+func getTransport(name string) (Transport, error) {
+	transportsMtx.RLock()
+	defer transportsMtx.RUnlock()
+	t, ok := transports[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown transport: %s", name)
+	}
+	return t, nil
+}
+
+// splitTransport splits an address in the form of transport://address
+func splitTransport(address string) (transport, addr string) {
+	if i := strings.Index(address, "://"); i >= 0 {
+		return address[:i], address[i+3:]
+	}
+	return "", address
+}
+
+type netListener struct {
+	net.Listener
+}
+
+func (l netListener) Accept() (io.ReadWriteCloser, error) {
+	return l.Listener.Accept()
+}
+
+type netDialer struct {
+	network   string
+	tlsConf   *tls.Config
+	httpProxy *url.URL
+}
+
+func (d *netDialer) Dial(address string) (io.ReadWriteCloser, error) {
+	return d.dial(address)
+}
+
+func (d *netDialer) dial(address string) (net.Conn, error) {
+	var conn net.Conn
+	var err error
+	if d.httpProxy != nil && d.network == "tcp" {
+		conn, err = dialHTTPProxy(d.httpProxy, address)
+	} else {
+		conn, err = net.DialTimeout(d.network, address, 10*time.Second)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if d.tlsConf == nil {
+		return conn, nil
+	}
+
+	tlsConn := tls.Client(conn, d.tlsConf)
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+type tlsTransport struct{}
+
+func (tlsTransport) NewDialer(conf *TransportConfig) (Dialer, error) {
+	return &netDialer{network: "tcp", tlsConf: conf.TLS, httpProxy: conf.HTTPProxy}, nil
+}
+
+func (tlsTransport) Listen(address string, conf *TransportConfig) (Listener, error) {
+	ln, err := listenTCP(address, conf)
+	if err != nil {
+		return nil, err
+	}
+	return netListener{tls.NewListener(ln, conf.TLS)}, nil
+}
+
+// tcpTransport sends data unencrypted and is meant for testing
+type tcpTransport struct{}
+
+func (tcpTransport) NewDialer(conf *TransportConfig) (Dialer, error) {
+	return &netDialer{network: "tcp", httpProxy: conf.HTTPProxy}, nil
+}
+
+func (tcpTransport) Listen(address string, conf *TransportConfig) (Listener, error) {
+	ln, err := listenTCP(address, conf)
+	if err != nil {
+		return nil, err
+	}
+	return netListener{ln}, nil
+}
+
+// listenTCP opens a TCP listener that accepts PROXY protocol headers from trusted proxies
+func listenTCP(address string, conf *TransportConfig) (net.Listener, error) {
+	ln, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	proxyLn, err := newProxyProtoListener(ln, conf.TrustedProxies)
+	if err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return proxyLn, nil
+}
+
+// unixTransport sends data unencrypted over a Unix domain socket
+type unixTransport struct{}
+
+func (unixTransport) NewDialer(conf *TransportConfig) (Dialer, error) {
+	return &netDialer{network: "unix"}, nil
+}
+
+func (unixTransport) Listen(address string, conf *TransportConfig) (Listener, error) {
+	ln, err := net.Listen("unix", address)
+	if err != nil {
+		return nil, err
+	}
+	return netListener{ln}, nil
+}
+
+// wsTransport tunnels the session through a WebSocket connection over TLS
+//
+// The server side is a TLS listener, because servers accept WebSocket
+// tunnels on any listener that speaks HTTP.
+type wsTransport struct{}
+
+func (wsTransport) NewDialer(conf *TransportConfig) (Dialer, error) {
+	return &wsDialer{
+		netDialer: netDialer{network: "tcp", tlsConf: conf.TLS, httpProxy: conf.HTTPProxy},
+		path:      conf.Path,
+	}, nil
+}
+
+func (wsTransport) Listen(address string, conf *TransportConfig) (Listener, error) {
+	return tlsTransport{}.Listen(address, conf)
+}
+
+type wsDialer struct {
+	netDialer
+	path string
+}
+
+func (d *wsDialer) Dial(address string) (io.ReadWriteCloser, error) {
+	conn, err := d.dial(address)
+	if err != nil {
+		return nil, err
+	}
+	ws, err := dialWebSocket(conn, address, d.path)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return ws, nil
+}
+
+// pipeTransport connects clients and servers of the same process with net.Pipe
+type pipeTransport struct {
+	mtx       sync.Mutex
+	listeners map[string]*pipeListener
+}
+
+func newPipeTransport() *pipeTransport {
+	return &pipeTransport{
+		listeners: make(map[string]*pipeListener),
+	}
+}
+
+func (t *pipeTransport) NewDialer(conf *TransportConfig) (Dialer, error) {
+	return t, nil
+}
+
+func (t *pipeTransport) Dial(address string) (io.ReadWriteCloser, error) {
+	t.mtx.Lock()
+	l, ok := t.listeners[address]
+	t.mtx.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("no pipe listener on %s", address)
+	}
+
+	client, server := net.Pipe()
+	go l.push(server)
+	return client, nil
+}
+
+func (t *pipeTransport) Listen(address string, conf *TransportConfig) (Listener, error) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	if _, ok := t.listeners[address]; ok {
+		return nil, fmt.Errorf("pipe address already in use: %s", address)
+	}
+	l := &pipeListener{
+		connListener: newConnListener(pipeAddr(address)),
+		transport:    t,
+	}
+	t.listeners[address] = l
+	return l, nil
+}
+
+type pipeListener struct {
+	*connListener
+	transport *pipeTransport
+}
+
+func (l *pipeListener) Accept() (io.ReadWriteCloser, error) {
+	return l.connListener.Accept()
+}
+
+func (l *pipeListener) Close() error {
+	l.transport.mtx.Lock()
+	delete(l.transport.listeners, l.addr.String())
+	l.transport.mtx.Unlock()
+	return l.connListener.Close()
+}
+
+type pipeAddr string
+
+func (a pipeAddr) Network() string { return TransportPipe }
+func (a pipeAddr) String() string  { return string(a) }
+
+// connListener is a net.Listener that serves connections handed over by the server
+type connListener struct {
+	addr      net.Addr
+	conns     chan net.Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newConnListener(addr net.Addr) *connListener {
+	return &connListener{
+		addr:   addr,
+		conns:  make(chan net.Conn),
+		closed: make(chan struct{}),
+	}
+}
+
+func (l *connListener) push(conn net.Conn) {
+	select {
+	case l.conns <- conn:
+	case <-l.closed:
+		conn.Close()
+	}
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *connListener) Close() error {
+	l.closeOnce.Do(func() { close(l.closed) })
+	return nil
+}
+
+func (l *connListener) Addr() net.Addr {
+	return l.addr
+}
@@ -0,0 +1,45 @@
+package razproxy
+
+import (
+	"net"
+
+	"github.com/armon/go-socks5"
+)
+
+// TunConfig contains the settings of the TUN device mode
+type TunConfig struct {
+	Name        string // name of the interface, default razproxy0
+	Addr        string // IPv4 address of the interface in CIDR notation, default 198.18.0.1/15
+	MTU         int    // default 1500
+	FakeIPRange string // IPs handed out by the DNS server of the interface, default is the network of Addr
+}
+
+func (conf *TunConfig) withDefaults() *TunConfig {
+	c := TunConfig{}
+	if conf != nil {
+		c = *conf
+	}
+	if len(c.Name) == 0 {
+		c.Name = "razproxy0"
+	}
+	if len(c.Addr) == 0 {
+		c.Addr = "198.18.0.1/15"
+	}
+	if c.MTU == 0 {
+		c.MTU = 1500
+	}
+	if len(c.FakeIPRange) == 0 {
+		if _, network, err := net.ParseCIDR(c.Addr); err == nil {
+			c.FakeIPRange = network.String()
+		}
+	}
+	return &c
+}
+
+// tunDest returns the destination of a flow, replacing fake IPs with their domain names
+func tunDest(fake *fakeDNS, ip net.IP, port int) *socks5.AddrSpec {
+	if name, ok := fake.lookup(ip); ok {
+		return &socks5.AddrSpec{FQDN: name, Port: port}
+	}
+	return &socks5.AddrSpec{IP: ip, Port: port}
+}
@@ -0,0 +1,174 @@
+package razproxy
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"golang.org/x/sys/unix"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/link/fdbased"
+	"gvisor.dev/gvisor/pkg/tcpip/link/tun"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/udp"
+	"gvisor.dev/gvisor/pkg/waiter"
+)
+
+const tunNIC tcpip.NICID = 1
+
+// ListenAndServeTun creates a TUN interface and tunnels the TCP connections
+// routed to it through the server
+//
+// The interface answers DNS queries on UDP port 53 with fake IPs, so that
+// connections made by domain name reach the server with the name. Other UDP
+// traffic is dropped, because sessions don't relay UDP. Routes to the
+// interface have to be added separately, excluding the addresses of the servers.
+func (c *Client) ListenAndServeTun(conf *TunConfig) error {
+	conf = conf.withDefaults()
+	ip, network, err := net.ParseCIDR(conf.Addr)
+	if err != nil {
+		return err
+	}
+	if ip.To4() == nil {
+		return fmt.Errorf("TUN address must be IPv4: %s", conf.Addr)
+	}
+	fake, err := newFakeDNS(conf.FakeIPRange, ip)
+	if err != nil {
+		return err
+	}
+
+	fd, err := tun.Open(conf.Name)
+	if err != nil {
+		return fmt.Errorf("cannot open TUN device %s: %w", conf.Name, err)
+	}
+	defer unix.Close(fd)
+	if err := configureTun(conf.Name, ip, network.Mask, conf.MTU); err != nil {
+		return fmt.Errorf("cannot configure TUN device %s: %w", conf.Name, err)
+	}
+
+	ep, err := fdbased.New(&fdbased.Options{
+		FDs: []int{fd},
+		MTU: uint32(conf.MTU),
+	})
+	if err != nil {
+		return err
+	}
+
+	s := stack.New(stack.Options{
+		NetworkProtocols:   []stack.NetworkProtocolFactory{ipv4.NewProtocol, ipv6.NewProtocol},
+		TransportProtocols: []stack.TransportProtocolFactory{tcp.NewProtocol, udp.NewProtocol},
+	})
+	defer s.Close()
+
+	tcpForwarder := tcp.NewForwarder(s, 0, 1024, func(r *tcp.ForwarderRequest) {
+		c.serveTunTCP(r, fake)
+	})
+	s.SetTransportProtocolHandler(tcp.ProtocolNumber, tcpForwarder.HandlePacket)
+	udpForwarder := udp.NewForwarder(s, func(r *udp.ForwarderRequest) {
+		if r.ID().LocalPort == 53 {
+			go c.serveTunDNS(r, fake)
+		}
+	})
+	s.SetTransportProtocolHandler(udp.ProtocolNumber, udpForwarder.HandlePacket)
+
+	if err := s.CreateNIC(tunNIC, ep); err != nil {
+		return fmt.Errorf("%s", err)
+	}
+	s.SetPromiscuousMode(tunNIC, true)
+	s.SetSpoofing(tunNIC, true)
+	s.SetRouteTable([]tcpip.Route{
+		{Destination: header.IPv4EmptySubnet, NIC: tunNIC},
+		{Destination: header.IPv6EmptySubnet, NIC: tunNIC},
+	})
+
+	c.Logger.Println("TUN interface", conf.Name, "is up with address", conf.Addr)
+	ep.Wait()
+	return fmt.Errorf("TUN interface %s closed", conf.Name)
+}
+
+func (c *Client) serveTunTCP(r *tcp.ForwarderRequest, fake *fakeDNS) {
+	id := r.ID()
+	dest := tunDest(fake, net.IP(id.LocalAddress.AsSlice()), int(id.LocalPort))
+	remote, err := c.dial(dest)
+	if err != nil {
+		r.Complete(true)
+		return
+	}
+	defer remote.Close()
+
+	var wq waiter.Queue
+	ep, tcpErr := r.CreateEndpoint(&wq)
+	if tcpErr != nil {
+		r.Complete(true)
+		return
+	}
+	r.Complete(false)
+
+	conn := gonet.NewTCPConn(&wq, ep)
+	defer conn.Close()
+	relay(conn, remote)
+}
+
+func (c *Client) serveTunDNS(r *udp.ForwarderRequest, fake *fakeDNS) {
+	var wq waiter.Queue
+	ep, err := r.CreateEndpoint(&wq)
+	if err != nil {
+		return
+	}
+	conn := gonet.NewUDPConn(&wq, ep)
+	defer conn.Close()
+
+	buf := make([]byte, 1500)
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	n, err2 := conn.Read(buf)
+	if err2 != nil {
+		return
+	}
+	resp, err2 := fake.handle(buf[:n])
+	if err2 != nil {
+		return
+	}
+	conn.Write(resp)
+}
+
+// configureTun sets the address, netmask and MTU of the interface and brings it up
+func configureTun(name string, ip net.IP, mask net.IPMask, mtu int) error {
+	sock, err := unix.Socket(unix.AF_INET, unix.SOCK_DGRAM, 0)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(sock)
+
+	ifr, err := unix.NewIfreq(name)
+	if err != nil {
+		return err
+	}
+	if err := ifr.SetInet4Addr(ip.To4()); err != nil {
+		return err
+	}
+	if err := unix.IoctlIfreq(sock, unix.SIOCSIFADDR, ifr); err != nil {
+		return err
+	}
+	if err := ifr.SetInet4Addr(net.IP(mask).To4()); err != nil {
+		return err
+	}
+	if err := unix.IoctlIfreq(sock, unix.SIOCSIFNETMASK, ifr); err != nil {
+		return err
+	}
+
+	ifr.SetUint32(uint32(mtu))
+	if err := unix.IoctlIfreq(sock, unix.SIOCSIFMTU, ifr); err != nil {
+		return err
+	}
+
+	if err := unix.IoctlIfreq(sock, unix.SIOCGIFFLAGS, ifr); err != nil {
+		return err
+	}
+	ifr.SetUint16(ifr.Uint16() | unix.IFF_UP | unix.IFF_RUNNING)
+	return unix.IoctlIfreq(sock, unix.SIOCSIFFLAGS, ifr)
+}
@@ -0,0 +1,54 @@
+package razproxy
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestTun(t *testing.T) {
+	if !runInNetNS(t) {
+		return
+	}
+	c, outbound := newTestClient(t)
+	go c.ListenAndServeTun(&TunConfig{Name: "rzptest0"})
+
+	// any address of the interface answers DNS queries, except its own
+	resolver := &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "udp", "198.19.255.253:53")
+		},
+	}
+	var ips []net.IP
+	var err error
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(50 * time.Millisecond) {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		ips, err = resolver.LookupIP(ctx, "ip4", "svc.test.")
+		cancel()
+		if err == nil || time.Now().After(deadline) {
+			break
+		}
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, fakeRange, _ := net.ParseCIDR("198.18.0.1/15")
+	if len(ips) != 1 || !fakeRange.Contains(ips[0]) {
+		t.Fatalf("expected a fake IP, got %v", ips)
+	}
+
+	// connections to fake IPs reach the server with the name, others with the IP
+	echoTest(t, func() (net.Conn, error) {
+		return net.Dial("tcp", net.JoinHostPort(ips[0].String(), "80"))
+	})
+	echoTest(t, func() (net.Conn, error) {
+		return net.Dial("tcp", "198.19.0.77:81")
+	})
+	if dests := outbound.getDests(); !reflect.DeepEqual(dests, []string{"svc.test:80", "198.19.0.77:81"}) {
+		t.Fatalf("unexpected destinations: %v", dests)
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package razproxy
+
+import "fmt"
+
+// ListenAndServeTun is only supported on Linux
+func (c *Client) ListenAndServeTun(conf *TunConfig) error {
+	return fmt.Errorf("TUN device mode is only supported on Linux")
+}
@@ -0,0 +1,92 @@
+package razproxy
+
+import (
+	"io"
+	"net"
+	"time"
+
+	"github.com/xtaci/smux"
+)
+
+// TunnelConfig contains the multiplexer settings of a session
+//
+// Zero values mean smux defaults. Client and server must use the same protocol version.
+type TunnelConfig struct {
+	Version           int // smux protocol version (1 or 2)
+	KeepAliveInterval time.Duration
+	KeepAliveTimeout  time.Duration
+	MaxFrameSize      int
+	MaxReceiveBuffer  int
+	MaxStreamBuffer   int
+}
+
+func (conf *TunnelConfig) smuxConfig() (*smux.Config, error) {
+	smuxConf := smux.DefaultConfig()
+	if conf != nil {
+		if conf.Version != 0 {
+			smuxConf.Version = conf.Version
+		}
+		if conf.KeepAliveInterval != 0 {
+			smuxConf.KeepAliveInterval = conf.KeepAliveInterval
+		}
+		if conf.KeepAliveTimeout != 0 {
+			smuxConf.KeepAliveTimeout = conf.KeepAliveTimeout
+		}
+		if conf.MaxFrameSize != 0 {
+			smuxConf.MaxFrameSize = conf.MaxFrameSize
+		}
+		if conf.MaxReceiveBuffer != 0 {
+			smuxConf.MaxReceiveBuffer = conf.MaxReceiveBuffer
+		}
+		if conf.MaxStreamBuffer != 0 {
+			smuxConf.MaxStreamBuffer = conf.MaxStreamBuffer
+		}
+	}
+	return smuxConf, smux.VerifyConfig(smuxConf)
+}
+
+// tunnel is a multiplexed connection between a client and a server
+type tunnel interface {
+	OpenStream() (net.Conn, error)
+	AcceptStream() (net.Conn, error)
+	NumStreams() int
+	RemoteAddr() net.Addr
+	Close() error
+}
+
+type smuxTunnel struct {
+	*smux.Session
+}
+
+func newSmuxTunnel(conn io.ReadWriteCloser, conf *TunnelConfig, server bool) (tunnel, error) {
+	smuxConf, err := conf.smuxConfig()
+	if err != nil {
+		return nil, err
+	}
+	var session *smux.Session
+	if server {
+		session, err = smux.Server(conn, smuxConf)
+	} else {
+		session, err = smux.Client(conn, smuxConf)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return smuxTunnel{session}, nil
+}
+
+func (t smuxTunnel) OpenStream() (net.Conn, error) {
+	stream, err := t.Session.OpenStream()
+	if err != nil {
+		return nil, err
+	}
+	return stream, nil
+}
+
+func (t smuxTunnel) AcceptStream() (net.Conn, error) {
+	stream, err := t.Session.AcceptStream()
+	if err != nil {
+		return nil, err
+	}
+	return stream, nil
+}
@@ -0,0 +1,206 @@
+package razproxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"hash/fnv"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/armon/go-socks5"
+)
+
+// Upstream contains the address and credentials of a server
+type Upstream struct {
+	Addr           string                 `json:"addr"`
+	User           string                 `json:"user"`
+	Password       string                 `json:"password"`
+	SkipCertVerify bool                   `json:"skip-cert-verify"`
+	Transport      string                 `json:"transport"`       // TransportTLS (default), TransportQUIC, TransportWebSocket or a registered transport
+	Path           string                 `json:"path"`            // HTTP path of WebSocket tunnels
+	Dialer         Dialer                 `json:"-"`               // overrides the transport if set
+	Secret         string                 `json:"secret"`          // pre-shared secret of the server
+	CredentialType string                 `json:"credential-type"` // CredentialBearer, CredentialJWT or CredentialHMAC to log in with a token instead of a password
+	Credential     func() (string, error) `json:"-"`               // returns the token on every login
+}
+
+// Strategy determines how the client picks an upstream server for a request
+type Strategy string
+
+// Supported strategies
+const (
+	StrategyFailover     Strategy = "failover"
+	StrategyRoundRobin   Strategy = "round-robin"
+	StrategyLeastLatency Strategy = "least-latency"
+	StrategySticky       Strategy = "sticky"
+)
+
+type upstream struct {
+	latency int64 // time.Duration
+	Upstream
+	client   *Client
+	mtx      sync.RWMutex
+	sessions []*clientSession
+	state    int32 // ConnState
+	growing  int32 // bool
+	token    string
+	// legacyControl is set if the server only speaks the net/rpc control protocol.
+	// It is cleared on reconnect, because the server may have been upgraded.
+	legacyControl int32
+	// skipCertVerify is set from SkipCertVerify, or when the user accepts an unknown certificate.
+	// It is atomic, because pooled sessions are opened while connecting.
+	skipCertVerify int32 // bool
+	// tlsSessions keeps the TLS session tickets, so reconnects skip the full handshake
+	tlsSessions tls.ClientSessionCache
+}
+
+func newUpstream(c *Client, conf Upstream) *upstream {
+	if name, addr := splitTransport(conf.Addr); len(name) > 0 {
+		conf.Transport, conf.Addr = name, addr
+	}
+	switch conf.Transport {
+	case TransportUnix, TransportPipe:
+	default:
+		if _, port, _ := net.SplitHostPort(conf.Addr); len(port) == 0 {
+			conf.Addr += ":9820"
+		}
+	}
+	u := &upstream{
+		Upstream:    conf,
+		client:      c,
+		state:       int32(StateDisconnected),
+		tlsSessions: tls.NewLRUClientSessionCache(0),
+	}
+	if conf.SkipCertVerify {
+		u.skipCertVerify = 1
+	}
+	return u
+}
+
+func (u *upstream) connect() error {
+	atomic.StoreInt32(&u.legacyControl, 0)
+	session, err := u.newSession("")
+	if err != nil {
+		prompt := u.client.conf.PromptSkipCertVerify
+		var certErr x509.UnknownAuthorityError
+		if !errors.As(err, &certErr) || prompt == nil {
+			return err
+		}
+		cont := prompt()
+		if cont {
+			atomic.StoreInt32(&u.skipCertVerify, 1)
+			session, err = u.newSession("")
+			if err != nil {
+				return err
+			}
+		} else {
+			return err
+		}
+	}
+
+	u.mtx.Lock()
+	u.sessions = []*clientSession{session}
+	u.mtx.Unlock()
+	u.client.Logger.Println("connected to", u.Addr, "as", session.id)
+	u.setState(StateConnected, 0, nil)
+	go u.startReverse(session)
+	return nil
+}
+
+func (u *upstream) isAvailable() bool {
+	return u.getState() == StateConnected
+}
+
+func (u *upstream) dial(dest *socks5.AddrSpec) (net.Conn, error) {
+	session := u.pickSession(dest)
+	if session == nil {
+		return nil, ErrNoServer
+	}
+	conn, err := session.dial(dest)
+	if err != nil {
+		if _, ok := err.(SocksError); !ok {
+			u.dropSession(session)
+		}
+	}
+	return conn, err
+}
+
+func (u *upstream) disconnect() {
+	if !atomic.CompareAndSwapInt32(&u.state, int32(StateConnected), int32(StateDisconnected)) {
+		return
+	}
+	u.mtx.Lock()
+	sessions := u.sessions
+	u.sessions = nil
+	u.mtx.Unlock()
+	for _, s := range sessions {
+		s.Close()
+	}
+	u.setState(StateDisconnected, 0, nil)
+	go u.reconnect()
+}
+
+func (u *upstream) healthCheck(interval time.Duration) {
+	for {
+		u.checkSessions()
+		time.Sleep(interval)
+	}
+}
+
+// checkSessions pings the sessions, drops the ones that don't answer and closes the idle ones
+func (u *upstream) checkSessions() {
+	for i, s := range u.getSessions() {
+		if s.isLegacy() {
+			continue // older servers can't be pinged, but smux keepalive closes dead sessions
+		}
+		rtt, err := s.ping(u.client.conf.PingTimeout)
+		if err != nil {
+			u.client.Logger.Println("health check failed for", u.Addr+":", err)
+			u.dropSession(s)
+		} else if i == 0 {
+			atomic.StoreInt64(&u.latency, int64(rtt))
+		}
+	}
+	u.shrink()
+}
+
+func (u *upstream) getLatency() time.Duration {
+	return time.Duration(atomic.LoadInt64(&u.latency))
+}
+
+// pick returns the available upstreams in the order they should be tried for dest
+func (c *Client) pick(dest *socks5.AddrSpec) []*upstream {
+	upstreams := make([]*upstream, 0, len(c.upstreams))
+	var start uint32
+	switch c.conf.Strategy {
+	case StrategyRoundRobin:
+		start = atomic.AddUint32(&c.next, 1)
+	case StrategySticky:
+		if dest == nil {
+			break
+		}
+		h := fnv.New32a()
+		if len(dest.FQDN) > 0 {
+			h.Write([]byte(dest.FQDN))
+		} else {
+			h.Write(dest.IP)
+		}
+		start = h.Sum32()
+	}
+	for i := range c.upstreams {
+		u := c.upstreams[(start+uint32(i))%uint32(len(c.upstreams))]
+		if u.isAvailable() {
+			upstreams = append(upstreams, u)
+		}
+	}
+	if c.conf.Strategy == StrategyLeastLatency {
+		sort.SliceStable(upstreams, func(i, j int) bool {
+			return upstreams[i].getLatency() < upstreams[j].getLatency()
+		})
+	}
+	return upstreams
+}
@@ -1,9 +1,13 @@
 package razproxy
 
 import (
+	"bufio"
+	"errors"
 	"fmt"
 	"io"
 	"net"
+	"os"
+	"sync/atomic"
 	"time"
 
 	"github.com/razzie/babble"
@@ -45,13 +49,115 @@ func isPrivateIP(ip net.IP) bool {
 	return false
 }
 
-func proxy(dst io.Writer, src io.Reader, errCh chan error) {
+// relayIdleTimeout is how long the remaining direction of a relay may be idle
+// after the other direction finished on a connection that can't be half-closed
+const relayIdleTimeout = 30 * time.Second
+
+// relay copies data between two connections until both directions are finished
+//
+// conn is the side that initiated the connection. When one direction finishes,
+// the writing side of its destination is closed if the connection supports
+// half-closing, so the peer sees the end of data but can still respond. Streams
+// of tunnels can't be half-closed: they are closed when the remote side is done,
+// and only wait for the response while data flows when conn is done.
+func relay(conn, remote net.Conn) error {
+	isExpectedErr := func(e error) bool {
+		if e == io.ErrClosedPipe || e == io.EOF || errors.Is(e, os.ErrDeadlineExceeded) {
+			return true
+		}
+		if e, ok := e.(*net.OpError); ok && e.Source == conn.LocalAddr() {
+			return true
+		}
+		return false
+	}
+
+	connReader := &relayReader{Conn: conn}
+	remoteReader := &relayReader{Conn: remote}
+	errCh := make(chan error, 2)
+	go proxy(remote, connReader, remoteReader, false, errCh)
+	go proxy(conn, remoteReader, connReader, true, errCh)
+	for i := 0; i < 2; i++ {
+		if e := <-errCh; e != nil {
+			if isExpectedErr(e) {
+				return nil
+			}
+			return e
+		}
+	}
+	return nil
+}
+
+// proxy copies src to dst, then half-closes dst if possible, otherwise closes
+// it if the remote side is done, or limits how long dstReader may stay idle
+func proxy(dst net.Conn, src, dstReader *relayReader, remoteDone bool, errCh chan error) {
 	_, err := io.Copy(dst, src)
+	if cw, ok := dst.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+	} else if remoteDone {
+		dst.Close()
+	} else {
+		atomic.StoreInt32(&dstReader.idle, 1)
+		dst.SetReadDeadline(time.Now().Add(relayIdleTimeout))
+	}
 	errCh <- err
 }
 
+// relayReader reads a connection of a relay, with an idle timeout once the idle flag is set
+type relayReader struct {
+	net.Conn
+	idle int32
+}
+
+func (r *relayReader) Read(b []byte) (int, error) {
+	if atomic.LoadInt32(&r.idle) == 1 {
+		r.Conn.SetReadDeadline(time.Now().Add(relayIdleTimeout))
+	}
+	return r.Conn.Read(b)
+}
+
+// socksStream is a stream served by go-socks5, which half-closes the client side
+// when the destination is done. Streams can't be half-closed, so they are closed,
+// the same way as relay does.
+type socksStream struct {
+	net.Conn
+}
+
+func (s *socksStream) CloseWrite() error {
+	return s.Conn.Close()
+}
+
 func uniqueID() string {
 	i := uint16(time.Now().UnixNano())
 	babbler := babble.NewBabbler()
 	return fmt.Sprintf("%s-%x", babbler.Babble(), i)
 }
+
+// bufferedConn is a net.Conn that reads through a bufio.Reader
+// so data can be peeked at without losing it
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func newBufferedConn(conn net.Conn) *bufferedConn {
+	return &bufferedConn{
+		Conn: conn,
+		r:    bufio.NewReader(conn),
+	}
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *bufferedConn) Peek(n int) ([]byte, error) {
+	return c.r.Peek(n)
+}
+
+// closeWrite shuts down the writing side of a connection if it supports half-closing
+func closeWrite(conn net.Conn) error {
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
@@ -0,0 +1,130 @@
+package razproxy
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const defaultDecoyPage = `<!DOCTYPE html>
+<html>
+<head><title>Welcome</title></head>
+<body><h1>It works!</h1></body>
+</html>
+`
+
+// wsConn adapts a WebSocket connection to net.Conn by sending data in binary messages
+type wsConn struct {
+	*websocket.Conn
+	reader  io.Reader
+	readMtx sync.Mutex
+}
+
+func newWSConn(conn *websocket.Conn) *wsConn {
+	return &wsConn{Conn: conn}
+}
+
+func (c *wsConn) Read(b []byte) (int, error) {
+	c.readMtx.Lock()
+	defer c.readMtx.Unlock()
+
+	for {
+		if c.reader == nil {
+			_, r, err := c.NextReader()
+			if err != nil {
+				if websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+					return 0, io.EOF
+				}
+				return 0, err
+			}
+			c.reader = r
+		}
+		n, err := c.reader.Read(b)
+		if err == io.EOF {
+			c.reader = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (c *wsConn) Write(b []byte) (int, error) {
+	if err := c.WriteMessage(websocket.BinaryMessage, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *wsConn) SetDeadline(t time.Time) error {
+	if err := c.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.SetWriteDeadline(t)
+}
+
+// dialWebSocket opens a WebSocket connection to the server over an existing TLS connection
+func dialWebSocket(conn net.Conn, addr, path string) (net.Conn, error) {
+	if len(path) == 0 {
+		path = "/"
+	}
+	dialer := &websocket.Dialer{
+		NetDialTLSContext: func(context.Context, string, string) (net.Conn, error) {
+			return conn, nil
+		},
+		HandshakeTimeout: 10 * time.Second,
+	}
+	u := &url.URL{Scheme: "wss", Host: addr, Path: path}
+	ws, _, err := dialer.Dial(u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	return newWSConn(ws), nil
+}
+
+// serveHTTP handles non-tunnel connections by upgrading requests to the
+// WebSocket path and answering everything else with the decoy page or
+// the fallback backend
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	if len(s.WebSocketPath) > 0 && r.URL.Path == s.WebSocketPath && websocket.IsWebSocketUpgrade(r) {
+		upgrader := &websocket.Upgrader{
+			CheckOrigin: func(*http.Request) bool { return true },
+		}
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		conn := newWSConn(ws)
+		if !s.allow(ws.RemoteAddr()) || !s.checkSecret(conn) {
+			ws.Close()
+			return
+		}
+		t, err := newSmuxTunnel(conn, s.Tunnel, true)
+		if err != nil {
+			s.Logger.Println("smux error:", err)
+			ws.Close()
+			return
+		}
+		s.newSession(t).run()
+		return
+	}
+
+	if s.Decoy != nil {
+		s.Decoy.ServeHTTP(w, r)
+		return
+	}
+	if len(s.Fallback) > 0 {
+		s.fallbackHandler().ServeHTTP(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html")
+	io.WriteString(w, defaultDecoyPage)
+}